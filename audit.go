@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/labstack/echo"
+)
+
+// Security related actions are recorded as audit/<id>, like changelog.
+// Admins see them in /admin/audit, or export as JSON lines by format=jsonl.
+// Both are paged by after=<id>, the export has the next page in Link header.
+// Pages can't be renamed, and there's no permission other than ACL,
+// so there are no actions for them.
+
+const (
+	auditLogin         = "login"
+	auditSignup        = "signup"
+	auditLogout        = "logout"
+	auditACL           = "acl"
+	auditDelete        = "delete"
+	auditShareCreate   = "share.create"
+	auditShareRevoke   = "share.revoke"
+	auditWebhookCreate = "webhook.create"
+	auditWebhookDelete = "webhook.delete"
+	auditCacheFlush    = "cache.flush"
+	auditFeedCreate    = "feed.create"
+	auditFeedRevoke    = "feed.revoke"
+)
+
+var auditActions = []string{
+	auditLogin, auditSignup, auditLogout, auditACL, auditDelete,
+	auditShareCreate, auditShareRevoke, auditWebhookCreate, auditWebhookDelete,
+	auditCacheFlush, auditFeedCreate, auditFeedRevoke,
+}
+
+const (
+	auditLimit       = 100
+	auditExportLimit = 1000
+)
+
+// audit records the action by the user of request.
+// Actor is the user of session if it's empty.
+func (h *handler) audit(c echo.Context, a *auditData) {
+	if a.Actor == "" {
+		if sess, ok := c.Get("session").(*sessionData); ok {
+			a.Actor = sess.User
+		}
+	}
+	a.IP = c.RealIP()
+	a.UserAgent = c.Request().UserAgent()
+	err := h.db.recordAudit(a)
+	if err != nil {
+		logger(c).WithField("error", err.Error()).Error("record audit failed")
+	}
+}
+
+func (w *Wikidata) recordAudit(a *auditData) error {
+	a.Time = time.Now()
+	random, err := randomString()
+	if err != nil {
+		return err
+	}
+	a.ID = invertedTime(a.Time) + "-" + random[:8]
+	return w.saveBare(a)
+}
+
+type auditFilter struct {
+	Actor  string
+	Action string
+	Since  time.Time
+	Until  time.Time
+}
+
+func (f auditFilter) match(a *auditData) bool {
+	return (f.Actor == "" || a.Actor == f.Actor) && (f.Action == "" || a.Action == f.Action)
+}
+
+// listAudit returns entries matching the filter after the ID, from the newest,
+// and the ID to continue if there may be more entries.
+// Entries are read from S3 directly, so that the export doesn't flush the cache.
+func (w *Wikidata) listAudit(f auditFilter, after string, limit int) ([]*auditData, string, error) {
+	params := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(w.bucket),
+		MaxKeys: aws.Int64(1000),
+		Prefix:  aws.String("audit/"),
+	}
+	if !f.Until.IsZero() {
+		params.StartAfter = aws.String(*params.Prefix + invertedTime(f.Until))
+	}
+	if after != "" && (params.StartAfter == nil || *params.StartAfter < *params.Prefix+after) {
+		params.StartAfter = aws.String(*params.Prefix + after)
+	}
+
+	var result []*auditData
+	for {
+		resp, err := w.svc.ListObjectsV2(params)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, c := range resp.Contents {
+			a := &auditData{ID: strings.TrimPrefix(*c.Key, *params.Prefix)}
+			err = w.loadBareDirect(a)
+			if err != nil {
+				continue
+			}
+			if !f.Since.IsZero() && a.Time.Before(f.Since) {
+				return result, "", nil
+			}
+			if f.match(a) {
+				result = append(result, a)
+			}
+			if len(result) >= limit {
+				return result, a.ID, nil
+			}
+		}
+		if resp.IsTruncated == nil || !*resp.IsTruncated {
+			return result, "", nil
+		}
+		params.ContinuationToken = resp.NextContinuationToken
+	}
+}
+
+func (h *handler) auditHandler(c echo.Context) (err error) {
+	// since and until are same as changelog.
+	cf, err := parseChangeFilter(c)
+	if err != nil {
+		return err
+	}
+	f := auditFilter{
+		Actor:  c.QueryParam("actor"),
+		Action: c.QueryParam("action"),
+		Since:  cf.Since,
+		Until:  cf.Until,
+	}
+
+	after := c.QueryParam("after")
+	nextURL := func(next string) string {
+		if next == "" {
+			return ""
+		}
+		q := c.Request().URL.Query()
+		q.Set("after", next)
+		return "/admin/audit?" + q.Encode()
+	}
+
+	if c.QueryParam("format") == "jsonl" {
+		entries, next, err := h.db.listAudit(f, after, auditExportLimit)
+		if err != nil {
+			return err
+		}
+		if next != "" {
+			c.Response().Header().Set("Link", "<"+h.db.config.URL+nextURL(next)+`>; rel="next"`)
+		}
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		for _, a := range entries {
+			err = enc.Encode(a)
+			if err != nil {
+				return err
+			}
+		}
+		c.Response().Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+		return c.Blob(http.StatusOK, "application/x-ndjson", buf.Bytes())
+	}
+
+	entries, next, err := h.db.listAudit(f, after, auditLimit)
+	if err != nil {
+		return err
+	}
+	return c.Render(http.StatusOK, "audit.html", map[string]interface{}{
+		"Actor":   f.Actor,
+		"Action":  f.Action,
+		"Since":   c.QueryParam("since"),
+		"Until":   c.QueryParam("until"),
+		"Entries": entries,
+		"Next":    nextURL(next),
+		"Actions": auditActions,
+	})
+}
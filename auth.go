@@ -7,7 +7,6 @@ import (
 	"fmt"
 	"net/http"
 
-	log "github.com/Sirupsen/logrus"
 	"github.com/labstack/echo"
 	"github.com/markbates/goth/gothic"
 	"github.com/pkg/errors"
@@ -29,9 +28,8 @@ func (h *handler) getSession(c echo.Context) (sess *sessionData, err error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "cookie not found")
 	}
-	log.Println("sessionID", sessionID.Value)
 	sess = &sessionData{ID: sessionID.Value}
-	err = h.db.loadBare(sess)
+	err = h.db.with(c).loadBare(sess)
 	if err != nil {
 		return nil, errors.Wrap(err, "loadBare failed")
 	}
@@ -43,8 +41,7 @@ func (h *handler) setSession(c echo.Context, sess *sessionData) (err error) {
 	if err != nil {
 		return err
 	}
-	log.Println("save session", sess.ID)
-	err = h.db.saveBare(sess)
+	err = h.db.with(c).saveBare(sess)
 	if err != nil {
 		return err
 	}
@@ -55,17 +52,30 @@ func (h *handler) setSession(c echo.Context, sess *sessionData) (err error) {
 func (h *handler) authMiddleware() echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) (err error) {
-			log.Println("Auth middleware")
 			session, err := h.getSession(c)
 			if err != nil {
-				log.Println("get session failed", err)
+				logger(c).WithField("error", err.Error()).Debug("get session failed")
 				return c.Redirect(http.StatusFound, "/login")
 			}
 			if session.Login == false {
-				log.Println("not login session")
+				logger(c).Debug("not login session")
 				return c.Redirect(http.StatusFound, "/login")
 			}
 			c.Set("session", session)
+			metrics.touchSession(session.ID)
+			return next(c)
+		}
+	}
+}
+
+// adminMiddleware must be used after authMiddleware.
+func (h *handler) adminMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (err error) {
+			session := c.Get("session").(*sessionData)
+			if !h.db.config.isAdmin(session.User) {
+				return echo.NewHTTPError(http.StatusForbidden, "admin only")
+			}
 			return next(c)
 		}
 	}
@@ -74,7 +84,8 @@ func (h *handler) authMiddleware() echo.MiddlewareFunc {
 func (h *handler) authCallbackHandler(c echo.Context) (err error) {
 	user, err := gothic.CompleteUserAuth(c.Response().Writer, c.Request())
 	if err != nil {
-		log.Println("User auth failed", err)
+		logger(c).WithField("error", err.Error()).Warn("user auth failed")
+		h.audit(c, &auditData{Action: auditLogin, Detail: "OAuth failed"})
 		return c.Redirect(http.StatusFound, "/500")
 	}
 
@@ -84,7 +95,7 @@ func (h *handler) authCallbackHandler(c echo.Context) (err error) {
 	userData.ID = user.Provider + user.UserID
 	userData.Token = user.AccessToken
 	userData.Secret = user.AccessTokenSecret
-	err = h.db.saveBare(&userData)
+	err = h.db.with(c).saveBare(&userData)
 	if err != nil {
 		return err
 	}
@@ -96,6 +107,7 @@ func (h *handler) authCallbackHandler(c echo.Context) (err error) {
 	if err != nil {
 		return err
 	}
+	h.audit(c, &auditData{Action: auditLogin, Actor: user.Name, Target: userData.ID, Success: true, Detail: user.Provider})
 
 	return c.Redirect(http.StatusFound, "/")
 }
@@ -112,22 +124,20 @@ func (h *handler) authHandler(c echo.Context) (err error) {
 func (h *handler) loginHandler(c echo.Context) (err error) {
 	username := c.FormValue("username")
 	if username == "" {
-		log.Println("Failed to get username")
+		logger(c).Debug("failed to get username")
 		return c.Redirect(http.StatusFound, "/login")
 	}
-	log.Println("username: ", username)
 	userData := &userData{
 		Name: username,
 	}
-	err = h.db.loadBare(userData)
+	err = h.db.with(c).loadBare(userData)
 	if err != nil {
-		log.Println("User is not found", err)
+		logger(c).WithField("user", username).Info("login failed, user is not found")
+		h.audit(c, &auditData{Action: auditLogin, Actor: username, Target: username, Detail: "user not found"})
 		return c.Redirect(http.StatusFound, "/login")
 	}
-	log.Println("userData.Name:", userData.Name)
 
 	response := c.FormValue("password")
-	log.Println("response: ", response)
 
 	sess, err := h.getSession(c)
 	if err != nil {
@@ -140,19 +150,19 @@ func (h *handler) loginHandler(c echo.Context) (err error) {
 	// Wiki admin or sniffer cannot see raw password string on network and S3.
 	answer := fmt.Sprintf("%x", sha256.Sum256([]byte(string(userData.Secret)+challange)))
 
-	log.Println("answer:   ", answer)
-
 	if answer == response {
-		log.Println("good answer")
+		logger(c).WithField("user", username).Info("login")
 		sess.Login = true
 		sess.User = username
 		err := h.setSession(c, sess)
 		if err != nil {
 			return err
 		}
+		h.audit(c, &auditData{Action: auditLogin, Actor: username, Target: username, Success: true})
 		return c.Redirect(http.StatusFound, "/")
 	}
-	log.Println("bad answer")
+	logger(c).WithField("user", username).Info("login failed, wrong password")
+	h.audit(c, &auditData{Action: auditLogin, Actor: username, Target: username, Detail: "wrong password"})
 	return c.Redirect(http.StatusFound, "/login")
 }
 
@@ -171,7 +181,6 @@ func (h *handler) loginPageHandler(c echo.Context) (err error) {
 		return err
 	}
 
-	log.Println("challange:", challange)
 	return c.Render(http.StatusOK, "auth.html", map[string]interface{}{
 		"Challenge": challange,
 	})
@@ -179,10 +188,11 @@ func (h *handler) loginPageHandler(c echo.Context) (err error) {
 
 func (h *handler) logoutHandler(c echo.Context) (err error) {
 	sess := c.Get("session").(*sessionData)
-	err = h.db.deleteBare(&sessionData{ID: sess.ID})
+	err = h.db.with(c).deleteBare(&sessionData{ID: sess.ID})
 	if err != nil {
 		return err
 	}
+	h.audit(c, &auditData{Action: auditLogout, Target: sess.User, Success: true})
 	return c.Redirect(http.StatusFound, "/login")
 }
 
@@ -194,25 +204,27 @@ func (h *handler) signupHandler(c echo.Context) (err error) {
 	var user userData
 	user.Name = c.FormValue("username")
 	if user.Name == "" {
-		log.Println("Failed to get username")
+		logger(c).Debug("failed to get username")
 		return c.Redirect(http.StatusFound, "/signup")
 	}
 
-	err = h.db.loadBare(&user)
+	err = h.db.with(c).loadBare(&user)
 	if err == nil {
-		log.Println("User already exist: ", user.Name)
+		logger(c).WithField("user", user.Name).Info("signup failed, user already exists")
+		h.audit(c, &auditData{Action: auditSignup, Actor: user.Name, Target: user.Name, Detail: "user already exists"})
 		return c.Redirect(http.StatusFound, "/signup")
 	}
 
-	log.Println("signup: ", user.Name)
+	logger(c).WithField("user", user.Name).Info("signup")
 
 	user.Secret = c.FormValue("password")
 
-	err = h.db.saveBare(&user)
+	err = h.db.with(c).saveBare(&user)
 	if err != nil {
-		log.Println("saveUser failed", err)
+		logger(c).WithField("error", err.Error()).Error("save user failed")
 		return c.Redirect(http.StatusFound, "/500")
 	}
+	h.audit(c, &auditData{Action: auditSignup, Actor: user.Name, Target: user.Name, Success: true})
 
 	return c.Redirect(http.StatusFound, "/login")
 }
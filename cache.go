@@ -1 +1,291 @@
 package main
+
+import (
+	"container/list"
+	"errors"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/juntaki/transparent/s3"
+	"github.com/labstack/echo"
+)
+
+// Every data type has a cache in front of its stack, named by the type
+// without "Data", such as "page" for pageData.
+// CACHE_CONFIG overrides the size and TTL of them, like
+//   page=1000:10m,session=5000:1h,default=200:5m
+// Missing objects are also cached for CACHE_NEGATIVE_TTL, so that links to
+// pages not created yet don't hit S3 every time.
+
+type cacheConfig struct {
+	Size        int           `json:"size"`
+	TTL         time.Duration `json:"ttl"` // 0 means no expiration
+	NegativeTTL time.Duration `json:"negativeTTL"`
+}
+
+var defaultCacheConfig = cacheConfig{Size: 100, TTL: 10 * time.Minute, NegativeTTL: 30 * time.Second}
+
+// defaultCacheSizes is for the types accessed by most requests.
+var defaultCacheSizes = map[string]int{
+	"page":    1000,
+	"session": 1000,
+	"user":    1000,
+	"file":    200,
+	"change":  200,
+}
+
+var errCachedNotFound = errors.New("not found (cached)")
+
+func cacheName(t reflect.Type) string {
+	return strings.TrimSuffix(t.Name(), "Data")
+}
+
+// validCacheName returns true for names of caches, "diagram" and "default".
+func validCacheName(name string) bool {
+	if name == "default" || name == "diagram" {
+		return true
+	}
+	for _, t := range cachedTypes {
+		if cacheName(t) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCacheConfig parses CACHE_CONFIG, with TTL of negative entries.
+// "default" is in the result only if it's set.
+func parseCacheConfig(str string, negativeTTL time.Duration) (map[string]cacheConfig, error) {
+	configs := make(map[string]cacheConfig)
+	base := defaultCacheConfig
+	base.NegativeTTL = negativeTTL
+	if str == "" {
+		return configs, nil
+	}
+
+	for _, item := range strings.Split(str, ",") {
+		kv := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.New("invalid cache config: " + item)
+		}
+		if !validCacheName(kv[0]) {
+			return nil, errors.New("unknown cache: " + item)
+		}
+		c := base
+		values := strings.SplitN(kv[1], ":", 2)
+		size, err := strconv.Atoi(values[0])
+		if err != nil || size <= 0 {
+			return nil, errors.New("invalid cache size: " + item)
+		}
+		c.Size = size
+		if len(values) == 2 {
+			c.TTL, err = time.ParseDuration(values[1])
+			if err != nil {
+				return nil, errors.New("invalid cache TTL: " + item)
+			}
+		}
+		configs[kv[0]] = c
+	}
+	return configs, nil
+}
+
+// cacheConfigOf returns the cache config of the type.
+// defaultCacheSizes apply only if "default" is not set by CACHE_CONFIG.
+func (w *Wikidata) cacheConfigOf(name string) cacheConfig {
+	if c, ok := w.cacheConfig[name]; ok {
+		return c
+	}
+	if c, ok := w.cacheConfig["default"]; ok {
+		return c
+	}
+	c := defaultCacheConfig
+	if w.config != nil {
+		c.NegativeTTL = w.config.Cache.NegativeTTL
+	}
+	if size, ok := defaultCacheSizes[name]; ok {
+		c.Size = size
+	}
+	return c
+}
+
+type cacheEntry struct {
+	key     s3.BareKey
+	value   *s3.Bare // nil if the object doesn't exist
+	expires time.Time
+}
+
+type cacheStats struct {
+	Name        string      `json:"name"`
+	Config      cacheConfig `json:"config"`
+	Len         int         `json:"len"`
+	Hits        int64       `json:"hits"`
+	Misses      int64       `json:"misses"`
+	Negative    int64       `json:"negativeHits"`
+	Evictions   int64       `json:"evictions"`
+	Expired     int64       `json:"expired"`
+	Invalidated int64       `json:"invalidated"` // by other instances
+}
+
+// cache is LRU with TTL and negative entries.
+type cache struct {
+	lock  sync.Mutex
+	ll    *list.List
+	items map[s3.BareKey]*list.Element
+	stats cacheStats
+}
+
+func newCache(name string, config cacheConfig) *cache {
+	return &cache{
+		ll:    list.New(),
+		items: make(map[s3.BareKey]*list.Element),
+		stats: cacheStats{Name: name, Config: config},
+	}
+}
+
+// get returns the cached value, and errCachedNotFound for negative entry.
+// ok is false if it's not cached.
+func (c *cache) get(key s3.BareKey) (value *s3.Bare, ok bool, err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		c.stats.Misses++
+		return nil, false, nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		c.ll.Remove(elem)
+		delete(c.items, key)
+		c.stats.Expired++
+		c.stats.Misses++
+		return nil, false, nil
+	}
+	c.ll.MoveToFront(elem)
+	if entry.value == nil {
+		c.stats.Negative++
+		return nil, true, errCachedNotFound
+	}
+	c.stats.Hits++
+	return entry.value, true, nil
+}
+
+// set caches the value. nil value is the negative entry.
+func (c *cache) set(key s3.BareKey, value *s3.Bare) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	ttl := c.stats.Config.TTL
+	if value == nil {
+		ttl = c.stats.Config.NegativeTTL
+		if ttl <= 0 {
+			c.remove(key)
+			return
+		}
+	}
+	entry := &cacheEntry{key: key, value: value}
+	if ttl > 0 {
+		entry.expires = time.Now().Add(ttl)
+	}
+
+	if elem, ok := c.items[key]; ok {
+		elem.Value = entry
+		c.ll.MoveToFront(elem)
+		return
+	}
+	c.items[key] = c.ll.PushFront(entry)
+	for c.ll.Len() > c.stats.Config.Size {
+		last := c.ll.Back()
+		c.ll.Remove(last)
+		delete(c.items, last.Value.(*cacheEntry).key)
+		c.stats.Evictions++
+	}
+}
+
+// remove must be called with lock.
+func (c *cache) remove(key s3.BareKey) {
+	if elem, ok := c.items[key]; ok {
+		c.ll.Remove(elem)
+		delete(c.items, key)
+	}
+}
+
+// invalidate drops the entry changed by other instance.
+func (c *cache) invalidate(key s3.BareKey) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.items[key]; ok {
+		c.remove(key)
+		c.stats.Invalidated++
+	}
+}
+
+func (c *cache) flush() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.ll.Init()
+	c.items = make(map[s3.BareKey]*list.Element)
+}
+
+func (c *cache) snapshot() cacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	stats := c.stats
+	stats.Len = c.ll.Len()
+	return stats
+}
+
+func isNotFound(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case "NoSuchKey", "NotFound", "NoSuchVersion":
+			return true
+		}
+	}
+	return false
+}
+
+// cacheStatus returns stats of all caches, sorted by name.
+func (w *Wikidata) cacheStatus() []cacheStats {
+	var stats []cacheStats
+	for _, c := range w.caches {
+		stats = append(stats, c.snapshot())
+	}
+	stats = append(stats, w.diagrams.snapshot())
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
+
+// flushCache flushes the named cache, or all caches for empty name.
+func (w *Wikidata) flushCache(name string) bool {
+	found := false
+	for t, c := range w.caches {
+		if name == "" || cacheName(t) == name {
+			c.flush()
+			found = true
+		}
+	}
+	if name == "" || name == "diagram" {
+		w.diagrams.flush()
+		found = true
+	}
+	return found
+}
+
+func (h *handler) cacheHandler(c echo.Context) (err error) {
+	return c.JSON(http.StatusOK, h.db.cacheStatus())
+}
+
+func (h *handler) flushCacheHandler(c echo.Context) (err error) {
+	if !h.db.flushCache(c.FormValue("name")) {
+		return echo.NewHTTPError(http.StatusNotFound, "unknown cache")
+	}
+	h.audit(c, &auditData{Action: auditCacheFlush, Target: c.FormValue("name"), Success: true})
+	return c.JSON(http.StatusOK, h.db.cacheStatus())
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/labstack/echo"
+)
+
+// Every change of pages is recorded as changelog/<id>.
+// id starts with the inverted time, so that S3 lists it from the newest.
+
+const (
+	changeCreate  = "create"
+	changeEdit    = "edit"
+	changeDelete  = "delete"
+	changePublic  = "public"
+	changePrivate = "private"
+)
+
+const (
+	recentLimit     = 50
+	changeScanLimit = 1000 // Changes to scan for filters at once
+)
+
+func invertedTime(t time.Time) string {
+	return fmt.Sprintf("%019d", math.MaxInt64-t.UnixNano())
+}
+
+// recordChange saves the change to the changelog, notifies watchers and
+// dispatches webhooks.
+// Failure is only logged, because the change itself is already done.
+func (w *Wikidata) recordChange(change *changeData) {
+	change.Time = time.Now()
+	random, err := randomString()
+	if err != nil {
+		log.WithField("error", err.Error()).Error("record change failed")
+		return
+	}
+	change.ID = invertedTime(change.Time) + "-" + random[:8]
+
+	err = w.saveBare(change)
+	if err != nil {
+		log.WithField("error", err.Error()).Error("record change failed")
+	}
+	w.notify(change)
+	w.dispatchChange(change)
+}
+
+type changeFilter struct {
+	User      string
+	Namespace string // Title prefix, like "Team" for "Team/..."
+	Since     time.Time
+	Until     time.Time
+}
+
+// parseChangeFilter parses user, namespace, since and until (2006-01-02) of query.
+func parseChangeFilter(c echo.Context) (changeFilter, error) {
+	f := changeFilter{
+		User:      c.QueryParam("user"),
+		Namespace: strings.Trim(c.QueryParam("namespace"), titleSeparator),
+	}
+	var err error
+	if since := c.QueryParam("since"); since != "" {
+		f.Since, err = time.Parse("2006-01-02", since)
+		if err != nil {
+			return f, echo.NewHTTPError(http.StatusBadRequest, "since should be YYYY-MM-DD")
+		}
+	}
+	if until := c.QueryParam("until"); until != "" {
+		f.Until, err = time.Parse("2006-01-02", until)
+		if err != nil {
+			return f, echo.NewHTTPError(http.StatusBadRequest, "until should be YYYY-MM-DD")
+		}
+		// Until the end of the day
+		f.Until = f.Until.Add(24 * time.Hour)
+	}
+	return f, nil
+}
+
+func (f changeFilter) match(change *changeData) bool {
+	if f.User != "" && change.User != f.User {
+		return false
+	}
+	if f.Namespace != "" && change.Title != f.Namespace &&
+		!strings.HasPrefix(change.Title, f.Namespace+titleSeparator) {
+		return false
+	}
+	return true
+}
+
+// query returns the filter as query string.
+func (f changeFilter) query() string {
+	v := url.Values{}
+	if f.User != "" {
+		v.Set("user", f.User)
+	}
+	if f.Namespace != "" {
+		v.Set("namespace", f.Namespace)
+	}
+	if !f.Since.IsZero() {
+		v.Set("since", f.Since.Format("2006-01-02"))
+	}
+	if !f.Until.IsZero() {
+		v.Set("until", f.Until.Add(-24*time.Hour).Format("2006-01-02"))
+	}
+	return v.Encode()
+}
+
+// listChanges returns changes matching the filter, from the newest.
+func (w *Wikidata) listChanges(f changeFilter, limit int) ([]*changeData, error) {
+	params := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(w.bucket),
+		MaxKeys: aws.Int64(100),
+		Prefix:  aws.String("changelog/"),
+	}
+	if !f.Until.IsZero() {
+		params.StartAfter = aws.String(*params.Prefix + invertedTime(f.Until))
+	}
+
+	var result []*changeData
+	scanned := 0
+	for {
+		resp, err := w.svc.ListObjectsV2(params)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range resp.Contents {
+			scanned++
+			change := &changeData{ID: strings.TrimPrefix(*c.Key, *params.Prefix)}
+			err = w.loadBare(change)
+			if err != nil {
+				continue
+			}
+			if !f.Since.IsZero() && change.Time.Before(f.Since) {
+				return result, nil
+			}
+			if f.match(change) {
+				result = append(result, change)
+			}
+			if len(result) >= limit || scanned >= changeScanLimit {
+				return result, nil
+			}
+		}
+		if resp.IsTruncated == nil || !*resp.IsTruncated {
+			return result, nil
+		}
+		params.ContinuationToken = resp.NextContinuationToken
+	}
+}
+
+// Feed token is <id>.<signature>, which authorizes feeds without login,
+// for chat integrations. Each user has own tokens, and revokes them by
+// deletion of feedTokenData.
+
+func (w *Wikidata) feedSignature(id string) string {
+	mac := hmac.New(sha256.New, []byte(w.wikiSecret))
+	mac.Write([]byte("feed/" + id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *Wikidata) feedToken(token *feedTokenData) string {
+	return token.ID + "." + w.feedSignature(token.ID)
+}
+
+// loadFeedToken validates str and returns the token.
+func (w *Wikidata) loadFeedToken(str string) (*feedTokenData, error) {
+	elem := strings.SplitN(str, ".", 2)
+	if len(elem) != 2 || !hmac.Equal([]byte(elem[1]), []byte(w.feedSignature(elem[0]))) {
+		return nil, echo.NewHTTPError(http.StatusNotFound)
+	}
+	token := &feedTokenData{ID: elem[0]}
+	err := w.loadBare(token)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound)
+	}
+	return token, nil
+}
+
+// listFeedTokens returns the tokens of the user, from the newest.
+func (w *Wikidata) listFeedTokens(user string) ([]*feedTokenData, error) {
+	params := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(w.bucket),
+		MaxKeys: aws.Int64(1000),
+		Prefix:  aws.String("feed/"),
+	}
+	var result []*feedTokenData
+	for {
+		resp, err := w.svc.ListObjectsV2(params)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range resp.Contents {
+			token := &feedTokenData{ID: strings.TrimPrefix(*c.Key, *params.Prefix)}
+			err = w.loadBare(token)
+			if err != nil || token.User != user {
+				continue
+			}
+			result = append(result, token)
+		}
+		if resp.IsTruncated == nil || !*resp.IsTruncated {
+			break
+		}
+		params.ContinuationToken = resp.NextContinuationToken
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Created.After(result[j].Created)
+	})
+	return result, nil
+}
+
+func (h *handler) createFeedTokenHandler(c echo.Context) (err error) {
+	id, err := randomString()
+	if err != nil {
+		return err
+	}
+	sess := c.Get("session").(*sessionData)
+	err = h.db.with(c).saveBare(&feedTokenData{ID: id, User: sess.User, Created: time.Now()})
+	if err != nil {
+		return err
+	}
+	h.audit(c, &auditData{Action: auditFeedCreate, Target: id[:8], Success: true})
+	return c.Redirect(http.StatusFound, "/recent")
+}
+
+func (h *handler) revokeFeedTokenHandler(c echo.Context) (err error) {
+	sess := c.Get("session").(*sessionData)
+	token := &feedTokenData{ID: c.Param("id")}
+	err = h.db.with(c).loadBare(token)
+	if err != nil || token.User != sess.User {
+		return echo.NewHTTPError(http.StatusNotFound, "feed token not found")
+	}
+	err = h.db.with(c).deleteBare(token)
+	if err != nil {
+		return err
+	}
+	h.audit(c, &auditData{Action: auditFeedRevoke, Target: token.ID[:8], Success: true})
+	return c.Redirect(http.StatusFound, "/recent")
+}
+
+func (h *handler) recentHandler(c echo.Context) (err error) {
+	f, err := parseChangeFilter(c)
+	if err != nil {
+		return err
+	}
+	changes, err := h.db.listChanges(f, recentLimit)
+	if err != nil {
+		return err
+	}
+
+	sess := c.Get("session").(*sessionData)
+	tokens, err := h.db.listFeedTokens(sess.User)
+	if err != nil {
+		return err
+	}
+	query := f.query()
+	if query != "" {
+		query += "&"
+	}
+	var feeds []map[string]interface{}
+	for _, token := range tokens {
+		feed := h.db.config.URL + "/feed/%s?" + query + "token=" + h.db.feedToken(token)
+		feeds = append(feeds, map[string]interface{}{
+			"ID":      token.ID,
+			"Created": token.Created,
+			"Atom":    fmt.Sprintf(feed, "atom"),
+			"RSS":     fmt.Sprintf(feed, "rss"),
+		})
+	}
+	return c.Render(http.StatusOK, "recent.html", map[string]interface{}{
+		"User":      f.User,
+		"Namespace": f.Namespace,
+		"Since":     c.QueryParam("since"),
+		"Until":     c.QueryParam("until"),
+		"Changes":   changes,
+		"Feeds":     feeds,
+	})
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title   string   `xml:"title"`
+	ID      string   `xml:"id"`
+	Updated string   `xml:"updated"`
+	Link    atomLink `xml:"link"`
+	Author  string   `xml:"author>name"`
+	Summary string   `xml:"summary"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Link    atomLink    `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type rssItem struct {
+	Title       string `xml:"title"`
+	Link        string `xml:"link"`
+	Description string `xml:"description"`
+	GUID        struct {
+		Value       string `xml:",chardata"`
+		IsPermaLink bool   `xml:"isPermaLink,attr"`
+	} `xml:"guid"`
+	PubDate string `xml:"pubDate"`
+}
+
+type rssFeed struct {
+	XMLName     xml.Name  `xml:"rss"`
+	Version     string    `xml:"version,attr"`
+	Title       string    `xml:"channel>title"`
+	Link        string    `xml:"channel>link"`
+	Description string    `xml:"channel>description"`
+	Items       []rssItem `xml:"channel>item"`
+}
+
+func (change *changeData) feedTitle() string {
+	return change.Title + " (" + change.Action + " by " + change.User + ")"
+}
+
+func (h *handler) feedHandler(c echo.Context) (err error) {
+	_, err = h.db.loadFeedToken(c.QueryParam("token"))
+	if err != nil {
+		return err
+	}
+	f, err := parseChangeFilter(c)
+	if err != nil {
+		return err
+	}
+	changes, err := h.db.listChanges(f, recentLimit)
+	if err != nil {
+		return err
+	}
+
+	base := h.db.config.URL
+
+	var feed interface{}
+	switch c.Param("format") {
+	case "atom":
+		atom := &atomFeed{
+			Title:   "Recent changes - Bucket Wiki",
+			ID:      base + "/recent",
+			Updated: time.Now().Format(time.RFC3339),
+			Link:    atomLink{Href: base + "/recent"},
+		}
+		for _, change := range changes {
+			atom.Entries = append(atom.Entries, atomEntry{
+				Title:   change.feedTitle(),
+				ID:      base + "/changelog/" + change.ID,
+				Updated: change.Time.Format(time.RFC3339),
+				Link:    atomLink{Href: pageURL(base, change)},
+				Author:  change.User,
+				Summary: change.Summary,
+			})
+		}
+		if len(changes) > 0 {
+			atom.Updated = changes[0].Time.Format(time.RFC3339)
+		}
+		feed = atom
+	case "rss":
+		rss := &rssFeed{
+			Version:     "2.0",
+			Title:       "Recent changes - Bucket Wiki",
+			Link:        base + "/recent",
+			Description: "Recent changes of Bucket Wiki",
+		}
+		for _, change := range changes {
+			item := rssItem{
+				Title:       change.feedTitle(),
+				Link:        pageURL(base, change),
+				Description: change.Summary,
+				PubDate:     change.Time.Format(time.RFC1123Z),
+			}
+			item.GUID.Value = base + "/changelog/" + change.ID
+			rss.Items = append(rss.Items, item)
+		}
+		feed = rss
+	default:
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	body, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		return err
+	}
+	contentType := "application/" + c.Param("format") + "+xml"
+	return c.Blob(http.StatusOK, contentType, append([]byte(xml.Header), body...))
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is loaded from defaults, the YAML file given by -config (or
+// BUCKETWIKI_CONFIG), environment variables and flags, in this order.
+// Environment variables are named by env tag, same as Heroku settings.
+
+type config struct {
+	Listen       string `yaml:"listen" env:"LISTEN"`
+	URL          string `yaml:"url" env:"URL"` // Base URL of the wiki, like https://wiki.example.com
+	Secret       string `yaml:"secret" env:"WIKI_SECRET"`
+	Debug        bool   `yaml:"debug" env:"DEBUG"`
+	MetricsToken string `yaml:"metricsToken" env:"METRICS_TOKEN"`
+
+	// Requests in progress are waited for this on shutdown.
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout" env:"SHUTDOWN_TIMEOUT"`
+
+	Storage  storageConfig  `yaml:"storage"`
+	Auth     authConfig     `yaml:"auth"`
+	Cache    cacheSettings  `yaml:"cache"`
+	Publish  publishConfig  `yaml:"publish"`
+	Markdown markdownConfig `yaml:"markdown"`
+	Notify   notifyConfig   `yaml:"notify"`
+	Log      logConfig      `yaml:"log"`
+	Limits   limitsConfig   `yaml:"limits"`
+	Jobs     jobsConfig     `yaml:"jobs"`
+}
+
+type storageConfig struct {
+	Bucket          string `yaml:"bucket" env:"AWS_BUCKET_NAME"`
+	Region          string `yaml:"region" env:"AWS_BUCKET_REGION"`
+	AccessKeyID     string `yaml:"accessKeyID" env:"AWS_ACCESS_KEY_ID"`
+	SecretAccessKey string `yaml:"secretAccessKey" env:"AWS_SECRET_ACCESS_KEY"`
+	Durability      string `yaml:"durability" env:"DURABILITY"`
+}
+
+type authConfig struct {
+	TwitterKey    string   `yaml:"twitterKey" env:"TWITTER_KEY"`
+	TwitterSecret string   `yaml:"twitterSecret" env:"TWITTER_SECRET"`
+	AdminUsers    []string `yaml:"adminUsers" env:"ADMIN_USERS"`
+}
+
+type cacheSettings struct {
+	Sizes                string        `yaml:"sizes" env:"CACHE_CONFIG"` // name=size[:ttl],...
+	NegativeTTL          time.Duration `yaml:"negativeTTL" env:"CACHE_NEGATIVE_TTL"`
+	Invalidation         string        `yaml:"invalidation" env:"CACHE_INVALIDATION"`
+	InvalidationInterval time.Duration `yaml:"invalidationInterval" env:"CACHE_INVALIDATION_INTERVAL"`
+}
+
+type publishConfig struct {
+	Target string `yaml:"target" env:"PUBLISH_TARGET"`
+	Dir    string `yaml:"dir" env:"PUBLISH_DIR"`
+	URL    string `yaml:"url" env:"PUBLIC_URL"`
+}
+
+type markdownConfig struct {
+	Extensions  string `yaml:"extensions" env:"MARKDOWN_EXTENSIONS"`
+	PlantUMLURL string `yaml:"plantUMLURL" env:"PLANTUML_URL"`
+}
+
+type notifyConfig struct {
+	Interval     time.Duration `yaml:"interval" env:"NOTIFY_INTERVAL"`
+	SMTPAddr     string        `yaml:"smtpAddr" env:"SMTP_ADDR"`
+	SMTPFrom     string        `yaml:"smtpFrom" env:"SMTP_FROM"`
+	SMTPUsername string        `yaml:"smtpUsername" env:"SMTP_USERNAME"`
+	SMTPPassword string        `yaml:"smtpPassword" env:"SMTP_PASSWORD"`
+}
+
+type logConfig struct {
+	Format string `yaml:"format" env:"LOG_FORMAT"`
+	Level  string `yaml:"level" env:"LOG_LEVEL"`
+}
+
+type jobsConfig struct {
+	SessionMaxAge        time.Duration `yaml:"sessionMaxAge" env:"SESSION_MAX_AGE"`
+	IndexRebuildInterval time.Duration `yaml:"indexRebuildInterval" env:"INDEX_REBUILD_INTERVAL"`
+}
+
+type limitsConfig struct {
+	MaxUploadSize int64 `yaml:"maxUploadSize" env:"MAX_UPLOAD_SIZE"` // bytes
+	MaxPageSize   int64 `yaml:"maxPageSize" env:"MAX_PAGE_SIZE"`     // bytes
+}
+
+func defaultConfig() *config {
+	return &config{
+		Listen: ":8080",
+		// Heroku kills the process 30 seconds after SIGTERM.
+		ShutdownTimeout: 25 * time.Second,
+		Cache: cacheSettings{
+			NegativeTTL:          defaultCacheConfig.NegativeTTL,
+			InvalidationInterval: 5 * time.Second,
+		},
+		Notify: notifyConfig{Interval: time.Hour},
+		Log:    logConfig{Format: "json", Level: "info"},
+		Limits: limitsConfig{
+			MaxUploadSize: 32 << 20,
+			MaxPageSize:   1 << 20,
+		},
+		Jobs: jobsConfig{
+			SessionMaxAge:        30 * 24 * time.Hour,
+			IndexRebuildInterval: 24 * time.Hour,
+		},
+	}
+}
+
+// loadConfig parses flags of args by fs, and loads the config.
+// Commands can define their own flags in fs before calling it.
+func loadConfig(fs *flag.FlagSet, args []string, lookupEnv func(string) (string, bool)) (*config, error) {
+	path, _ := lookupEnv("BUCKETWIKI_CONFIG")
+	fs.StringVar(&path, "config", path, "YAML config file")
+	listen := fs.String("listen", "", "listen address, like :8080")
+	baseURL := fs.String("url", "", "base URL of the wiki")
+	debug := fs.Bool("debug", false, "debug mode")
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	c := defaultConfig()
+	if path != "" {
+		body, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		err = yaml.UnmarshalStrict(body, c)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	// Heroku gives the port by PORT.
+	if port, ok := lookupEnv("PORT"); ok && port != "" {
+		c.Listen = ":" + port
+	}
+	errs := setEnv(reflect.ValueOf(c).Elem(), lookupEnv)
+
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			c.Listen = *listen
+		case "url":
+			c.URL = *baseURL
+		case "debug":
+			c.Debug = *debug
+		}
+	})
+
+	errs = append(errs, c.validate()...)
+	if len(errs) > 0 {
+		var messages []string
+		for _, err := range errs {
+			messages = append(messages, "  "+err.Error())
+		}
+		return nil, errors.New("invalid config:\n" + strings.Join(messages, "\n"))
+	}
+	return c, nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// setEnv sets fields of v by environment variables named by env tag.
+func setEnv(v reflect.Value, lookupEnv func(string) (string, bool)) []error {
+	var errs []error
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			errs = append(errs, setEnv(field, lookupEnv)...)
+			continue
+		}
+		name := v.Type().Field(i).Tag.Get("env")
+		value, ok := lookupEnv(name)
+		if name == "" || !ok {
+			continue
+		}
+
+		switch {
+		case field.Type() == durationType:
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid duration %q", name, value))
+				continue
+			}
+			field.SetInt(int64(d))
+		case field.Kind() == reflect.String:
+			field.SetString(value)
+		case field.Kind() == reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: should be true or false, but %q", name, value))
+				continue
+			}
+			field.SetBool(b)
+		case field.Kind() == reflect.Int64:
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: invalid number %q", name, value))
+				continue
+			}
+			field.SetInt(n)
+		case field.Kind() == reflect.Slice:
+			var items []string
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			field.Set(reflect.ValueOf(items))
+		}
+	}
+	return errs
+}
+
+// validate returns all errors of the config, and normalizes URLs.
+func (c *config) validate() []error {
+	var errs []error
+	required := func(value, name string) {
+		if value == "" {
+			errs = append(errs, errors.New(name+" is required"))
+		}
+	}
+	validURL := func(value, name string) string {
+		u, err := url.Parse(value)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("%s should be http(s)://host[/path], but %q", name, value))
+		}
+		return strings.TrimSuffix(value, "/")
+	}
+
+	required(c.Storage.Bucket, "storage.bucket (AWS_BUCKET_NAME)")
+	required(c.Storage.Region, "storage.region (AWS_BUCKET_REGION)")
+	if (c.Storage.AccessKeyID == "") != (c.Storage.SecretAccessKey == "") {
+		errs = append(errs, errors.New("storage.accessKeyID (AWS_ACCESS_KEY_ID) and storage.secretAccessKey (AWS_SECRET_ACCESS_KEY) should be set together"))
+	}
+	required(c.Secret, "secret (WIKI_SECRET)")
+	required(c.URL, "url (URL)")
+	if c.URL != "" {
+		c.URL = validURL(c.URL, "url (URL)")
+	}
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		errs = append(errs, fmt.Errorf("listen should be [host]:port, but %q", c.Listen))
+	}
+
+	if (c.Auth.TwitterKey == "") != (c.Auth.TwitterSecret == "") {
+		errs = append(errs, errors.New("auth.twitterKey (TWITTER_KEY) and auth.twitterSecret (TWITTER_SECRET) should be set together"))
+	}
+
+	if _, err := parseDurability(c.Storage.Durability); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := parseCacheConfig(c.Cache.Sizes, c.Cache.NegativeTTL); err != nil {
+		errs = append(errs, err)
+	}
+	switch c.Cache.Invalidation {
+	case "", "none", "memory", "s3":
+	default:
+		errs = append(errs, errors.New("unknown cache invalidation: "+c.Cache.Invalidation))
+	}
+	if c.Cache.InvalidationInterval <= 0 {
+		errs = append(errs, errors.New("cache.invalidationInterval should be positive"))
+	}
+
+	switch c.Publish.Target {
+	case "", "s3", "server":
+	case "dir":
+		required(c.Publish.Dir, "publish.dir (PUBLISH_DIR) for dir target")
+		// Sitemap and links of the site need absolute URLs.
+		required(c.Publish.URL, "publish.url (PUBLIC_URL) for dir target")
+	default:
+		errs = append(errs, errors.New("unknown publish target: "+c.Publish.Target))
+	}
+	if c.Publish.URL != "" {
+		c.Publish.URL = validURL(c.Publish.URL, "publish.url (PUBLIC_URL)")
+	}
+
+	if _, err := parseRenderOptions(c.Markdown.Extensions); err != nil {
+		errs = append(errs, err)
+	}
+	if c.Markdown.PlantUMLURL != "" {
+		c.Markdown.PlantUMLURL = validURL(c.Markdown.PlantUMLURL, "markdown.plantUMLURL (PLANTUML_URL)")
+	}
+
+	if c.Notify.Interval <= 0 {
+		errs = append(errs, errors.New("notify.interval should be positive"))
+	}
+	if c.Notify.SMTPAddr != "" {
+		if _, _, err := net.SplitHostPort(c.Notify.SMTPAddr); err != nil {
+			errs = append(errs, fmt.Errorf("notify.smtpAddr should be host:port, but %q", c.Notify.SMTPAddr))
+		}
+		required(c.Notify.SMTPFrom, "notify.smtpFrom (SMTP_FROM) for SMTP")
+	}
+
+	switch c.Log.Format {
+	case "", "json", "text":
+	default:
+		errs = append(errs, errors.New("unknown log format: "+c.Log.Format))
+	}
+	if _, err := log.ParseLevel(c.Log.Level); err != nil {
+		errs = append(errs, err)
+	}
+
+	if c.Limits.MaxUploadSize <= 0 || c.Limits.MaxPageSize <= 0 {
+		errs = append(errs, errors.New("limits should be positive"))
+	}
+	if c.ShutdownTimeout < 0 {
+		errs = append(errs, errors.New("shutdownTimeout should not be negative"))
+	}
+	if c.Jobs.SessionMaxAge <= 0 || c.Jobs.IndexRebuildInterval <= 0 {
+		errs = append(errs, errors.New("jobs.sessionMaxAge and jobs.indexRebuildInterval should be positive"))
+	}
+	return errs
+}
+
+func (c *config) isAdmin(user string) bool {
+	for _, admin := range c.Auth.AdminUsers {
+		if admin == user {
+			return true
+		}
+	}
+	return false
+}
+
+// configCommand runs "bucketwiki config check [flags]".
+func configCommand(args []string) int {
+	if len(args) == 0 || args[0] != "check" {
+		fmt.Fprintln(os.Stderr, "usage: bucketwiki config check [-config file] [flags]")
+		return 2
+	}
+	fs := flag.NewFlagSet("config check", flag.ContinueOnError)
+	c, err := loadConfig(fs, args[1:], os.LookupEnv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("config ok: bucket %s (%s), listen %s, url %s\n", c.Storage.Bucket, c.Storage.Region, c.Listen, c.URL)
+	return 0
+}
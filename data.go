@@ -18,48 +18,114 @@ type s3Bare interface {
 }
 
 func (w *Wikidata) saveBare(item s3Bare) error {
-	stack := w.cacheStack[reflect.TypeOf(item).Elem()]
+	return w.background().saveBare(item)
+}
+
+func (w *Wikidata) loadBare(item s3Bare) error {
+	return w.background().loadBare(item)
+}
+
+// loadBareDirect loads item from S3 without the cache, for objects
+// which are read in bulk and rarely read again, such as audit entries.
+func (w *Wikidata) loadBareDirect(item s3Bare) error {
+	return w.background().loadBareDirect(item)
+}
+
+func (w *Wikidata) deleteBare(item s3Bare) error {
+	return w.background().deleteBare(item)
+}
+
+func (s *storageCall) saveBare(item s3Bare) error {
+	t := reflect.TypeOf(item).Elem()
+	stack := s.cacheStack[t]
 
 	bareKey, bareValue, err := item.getBare()
 	if err != nil {
 		return err
 	}
 
-	bareKey.Bucket = w.bucket
-	return stack.Set(bareKey, bareValue)
+	bareKey.Bucket = s.bucket
+	err = s.write(stack, func() error {
+		return stack.Set(bareKey, bareValue)
+	})
+	if err != nil {
+		return err
+	}
+	s.caches[t].set(bareKey, bareValue)
+	s.invalidate(cacheName(t), bareKey)
+	return nil
 }
 
-func (w *Wikidata) loadBare(item s3Bare) error {
-	stack := w.cacheStack[reflect.TypeOf(item).Elem()]
+func (s *storageCall) loadBare(item s3Bare) error {
+	t := reflect.TypeOf(item).Elem()
+	stack := s.cacheStack[t]
 
 	bareKey, _, err := item.getBare()
 	if err != nil {
 		return err
 	}
-	bareKey.Bucket = w.bucket
-	bareValue, err := stack.Get(bareKey)
+	bareKey.Bucket = s.bucket
+	bareValue, ok, err := s.caches[t].get(bareKey)
 	if err != nil {
 		return err
 	}
+	if !ok {
+		var v interface{}
+		err := s.retry(func() (err error) {
+			v, err = stack.Get(bareKey)
+			return err
+		})
+		if err != nil {
+			if isNotFound(err) {
+				s.caches[t].set(bareKey, nil)
+			}
+			return err
+		}
+		bareValue = v.(*s3.Bare)
+		s.caches[t].set(bareKey, bareValue)
+	}
 
-	err = item.setBare(bareValue.(*s3.Bare))
+	err = item.setBare(bareValue)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (w *Wikidata) deleteBare(item s3Bare) error {
-	stack := w.cacheStack[reflect.TypeOf(item).Elem()]
+func (s *storageCall) loadBareDirect(item s3Bare) error {
+	stack := s.cacheStack[reflect.TypeOf(item).Elem()]
 	bareKey, _, err := item.getBare()
 	if err != nil {
 		return err
 	}
-	bareKey.Bucket = w.bucket
-	err = stack.Remove(bareKey)
+	bareKey.Bucket = s.bucket
+	var v interface{}
+	err = s.retry(func() (err error) {
+		v, err = stack.Get(bareKey)
+		return err
+	})
 	if err != nil {
 		return err
 	}
+	return item.setBare(v.(*s3.Bare))
+}
+
+func (s *storageCall) deleteBare(item s3Bare) error {
+	t := reflect.TypeOf(item).Elem()
+	stack := s.cacheStack[t]
+	bareKey, _, err := item.getBare()
+	if err != nil {
+		return err
+	}
+	bareKey.Bucket = s.bucket
+	err = s.write(stack, func() error {
+		return stack.Remove(bareKey)
+	})
+	if err != nil {
+		return err
+	}
+	s.caches[t].set(bareKey, nil)
+	s.invalidate(cacheName(t), bareKey)
 	return nil
 }
 
@@ -122,30 +188,6 @@ func (page *pageData) setBare(b *s3.Bare) error {
 	return nil
 }
 
-type htmlData struct {
-	titleHash string // Key
-	body      string
-}
-
-func (h *htmlData) getKey() string {
-	return "page/" + h.titleHash + "/index.html"
-}
-
-func (h *htmlData) getBare() (key s3.BareKey, value *s3.Bare, err error) {
-	bk := s3.BareKey{
-		Key: "page/" + h.titleHash + "/index.html",
-	}
-
-	bv := s3.NewBare()
-	bv.Value["Body"] = []byte(h.body)
-	bv.Value["ContentType"] = aws.String("text/html")
-	return bk, bv, nil
-}
-
-func (h *htmlData) setBare(b *s3.Bare) error {
-	panic("don't load html")
-}
-
 type userData struct {
 	ID               string `json:"id"` // Key
 	Name             string `json:"name"`
@@ -211,11 +253,10 @@ func (file *fileData) setBare(b *s3.Bare) error {
 }
 
 type sessionData struct {
-	ID         string       `json:"id"` // Key
-	Challange  string       `json:"challange"`
-	User       string       `json:"user"`
-	BreadCrumb []([]string) `json:"breadcrumb"`
-	Login      bool         `json:"login"`
+	ID        string `json:"id"` // Key
+	Challange string `json:"challange"`
+	User      string `json:"user"`
+	Login     bool   `json:"login"`
 }
 
 func (session *sessionData) getBare() (key s3.BareKey, value *s3.Bare, err error) {
@@ -247,3 +288,549 @@ func (session *sessionData) setBare(b *s3.Bare) error {
 	}
 	return nil
 }
+
+type publicPage struct {
+	Title      string    `json:"title"`
+	TitleHash  string    `json:"titleHash"`
+	LastUpdate time.Time `json:"lastUpdate"`
+}
+
+// publicIndexData is the list of published pages, kept private in the bucket.
+type publicIndexData struct {
+	Pages map[string]*publicPage `json:"pages"` // titleHash -> page
+}
+
+func (index *publicIndexData) getBare() (key s3.BareKey, value *s3.Bare, err error) {
+	bk := s3.BareKey{
+		Key: "publish/index.json",
+	}
+
+	body, err := json.Marshal(index)
+	if err != nil {
+		return bk, nil, err
+	}
+	bv := s3.NewBare()
+	bv.Value["Body"] = body
+	bv.Value["ContentType"] = aws.String("application/json")
+	return bk, bv, nil
+}
+
+func (index *publicIndexData) setBare(b *s3.Bare) error {
+	body, ok := b.Value["Body"].([]byte)
+	if !ok {
+		return errors.New("invalid body type")
+	}
+	err := json.Unmarshal(body, index)
+	if err != nil {
+		return err
+	}
+	if index.Pages == nil {
+		index.Pages = make(map[string]*publicPage)
+	}
+	return nil
+}
+
+// titleIndexData is the titles of all pages, because the key of page is hashed.
+type titleIndexData struct {
+	Titles map[string]string `json:"titles"` // titleHash -> title
+}
+
+func (index *titleIndexData) getBare() (key s3.BareKey, value *s3.Bare, err error) {
+	bk := s3.BareKey{
+		Key: "index/titles.json",
+	}
+
+	body, err := json.Marshal(index)
+	if err != nil {
+		return bk, nil, err
+	}
+	bv := s3.NewBare()
+	bv.Value["Body"] = body
+	bv.Value["ContentType"] = aws.String("application/json")
+	return bk, bv, nil
+}
+
+func (index *titleIndexData) setBare(b *s3.Bare) error {
+	body, ok := b.Value["Body"].([]byte)
+	if !ok {
+		return errors.New("invalid body type")
+	}
+	err := json.Unmarshal(body, index)
+	if err != nil {
+		return err
+	}
+	if index.Titles == nil {
+		index.Titles = make(map[string]string)
+	}
+	return nil
+}
+
+// reverseIndex is key -> set of titleHash, such as tag -> pages.
+type reverseIndex map[string]map[string]bool
+
+// set replaces the keys of the page, and returns true if index is changed.
+func (r reverseIndex) set(titleHash string, keys []string) bool {
+	changed := false
+	keep := make(map[string]bool)
+	for _, key := range keys {
+		keep[key] = true
+		if r[key] == nil {
+			r[key] = make(map[string]bool)
+		}
+		if !r[key][titleHash] {
+			r[key][titleHash] = true
+			changed = true
+		}
+	}
+	for key, pages := range r {
+		if pages[titleHash] && !keep[key] {
+			delete(pages, titleHash)
+			if len(pages) == 0 {
+				delete(r, key)
+			}
+			changed = true
+		}
+	}
+	return changed
+}
+
+// keys returns the keys of the page.
+func (r reverseIndex) keys(titleHash string) []string {
+	var keys []string
+	for key, pages := range r {
+		if pages[titleHash] {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// includeIndexData is the reverse index of includes, to update including pages.
+type includeIndexData struct {
+	Includers reverseIndex `json:"includers"` // included titleHash -> including pages
+}
+
+func (index *includeIndexData) getBare() (key s3.BareKey, value *s3.Bare, err error) {
+	bk := s3.BareKey{
+		Key: "index/includes.json",
+	}
+
+	body, err := json.Marshal(index)
+	if err != nil {
+		return bk, nil, err
+	}
+	bv := s3.NewBare()
+	bv.Value["Body"] = body
+	bv.Value["ContentType"] = aws.String("application/json")
+	return bk, bv, nil
+}
+
+func (index *includeIndexData) setBare(b *s3.Bare) error {
+	body, ok := b.Value["Body"].([]byte)
+	if !ok {
+		return errors.New("invalid body type")
+	}
+	err := json.Unmarshal(body, index)
+	if err != nil {
+		return err
+	}
+	if index.Includers == nil {
+		index.Includers = make(reverseIndex)
+	}
+	return nil
+}
+
+// tagIndexData is the pages of each tag.
+type tagIndexData struct {
+	Pages reverseIndex `json:"pages"` // tag -> pages
+}
+
+func (index *tagIndexData) getBare() (key s3.BareKey, value *s3.Bare, err error) {
+	bk := s3.BareKey{
+		Key: "index/tags.json",
+	}
+
+	body, err := json.Marshal(index)
+	if err != nil {
+		return bk, nil, err
+	}
+	bv := s3.NewBare()
+	bv.Value["Body"] = body
+	bv.Value["ContentType"] = aws.String("application/json")
+	return bk, bv, nil
+}
+
+func (index *tagIndexData) setBare(b *s3.Bare) error {
+	body, ok := b.Value["Body"].([]byte)
+	if !ok {
+		return errors.New("invalid body type")
+	}
+	err := json.Unmarshal(body, index)
+	if err != nil {
+		return err
+	}
+	if index.Pages == nil {
+		index.Pages = make(reverseIndex)
+	}
+	return nil
+}
+
+// metaIndexData is the front-matter of pages, to filter pages by properties.
+type metaIndexData struct {
+	Pages map[string]*frontMatter `json:"pages"` // titleHash -> front-matter
+}
+
+func (index *metaIndexData) getBare() (key s3.BareKey, value *s3.Bare, err error) {
+	bk := s3.BareKey{
+		Key: "index/meta.json",
+	}
+
+	body, err := json.Marshal(index)
+	if err != nil {
+		return bk, nil, err
+	}
+	bv := s3.NewBare()
+	bv.Value["Body"] = body
+	bv.Value["ContentType"] = aws.String("application/json")
+	return bk, bv, nil
+}
+
+func (index *metaIndexData) setBare(b *s3.Bare) error {
+	body, ok := b.Value["Body"].([]byte)
+	if !ok {
+		return errors.New("invalid body type")
+	}
+	err := json.Unmarshal(body, index)
+	if err != nil {
+		return err
+	}
+	if index.Pages == nil {
+		index.Pages = make(map[string]*frontMatter)
+	}
+	return nil
+}
+
+// staticData is a generated file of the public site, such as index.html or sitemap.xml.
+type staticData struct {
+	path        string // Key
+	body        []byte
+	contentType string
+}
+
+func (st *staticData) getBare() (key s3.BareKey, value *s3.Bare, err error) {
+	bk := s3.BareKey{
+		Key: st.path,
+	}
+
+	bv := s3.NewBare()
+	bv.Value["Body"] = st.body
+	bv.Value["ContentType"] = aws.String(st.contentType)
+	return bk, bv, nil
+}
+
+func (st *staticData) setBare(b *s3.Bare) error {
+	body, ok := b.Value["Body"].([]byte)
+	if !ok {
+		return errors.New("invalid body type")
+	}
+
+	st.body = body
+	st.contentType = *b.Value["ContentType"].(*string)
+	return nil
+}
+
+type shareData struct {
+	ID        string    `json:"id"`        // Key
+	TitleHash string    `json:"titleHash"` // Key
+	Creator   string    `json:"creator"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+	Files     bool      `json:"files"` // Attachments are also shared
+}
+
+func (share *shareData) expired(now time.Time) bool {
+	return now.After(share.Expires)
+}
+
+func (share *shareData) getBare() (key s3.BareKey, value *s3.Bare, err error) {
+	bk := s3.BareKey{
+		Key: "page/" + share.TitleHash + "/share/" + share.ID,
+	}
+
+	body, err := json.Marshal(share)
+	if err != nil {
+		return bk, nil, err
+	}
+	bv := s3.NewBare()
+	bv.Value["Body"] = body
+	bv.Value["ContentType"] = aws.String("application/json")
+	return bk, bv, nil
+}
+
+func (share *shareData) setBare(b *s3.Bare) error {
+	body, ok := b.Value["Body"].([]byte)
+	if !ok {
+		return errors.New("invalid body type")
+	}
+	err := json.Unmarshal(body, share)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// feedTokenData authorizes feeds of the user without login, until revoked.
+type feedTokenData struct {
+	ID      string    `json:"id"` // Key
+	User    string    `json:"user"`
+	Created time.Time `json:"created"`
+}
+
+func (token *feedTokenData) getBare() (key s3.BareKey, value *s3.Bare, err error) {
+	bk := s3.BareKey{
+		Key: "feed/" + token.ID,
+	}
+
+	body, err := json.Marshal(token)
+	if err != nil {
+		return bk, nil, err
+	}
+	bv := s3.NewBare()
+	bv.Value["Body"] = body
+	bv.Value["ContentType"] = aws.String("application/json")
+	return bk, bv, nil
+}
+
+func (token *feedTokenData) setBare(b *s3.Bare) error {
+	body, ok := b.Value["Body"].([]byte)
+	if !ok {
+		return errors.New("invalid body type")
+	}
+	return json.Unmarshal(body, token)
+}
+
+// changeData is an entry of the changelog.
+type changeData struct {
+	ID        string    `json:"id"` // Key, sorted from the newest
+	Time      time.Time `json:"time"`
+	User      string    `json:"user"`
+	Action    string    `json:"action"`
+	TitleHash string    `json:"titleHash"`
+	Title     string    `json:"title"`
+	Summary   string    `json:"summary"`
+}
+
+func (change *changeData) getBare() (key s3.BareKey, value *s3.Bare, err error) {
+	bk := s3.BareKey{
+		Key: "changelog/" + change.ID,
+	}
+
+	body, err := json.Marshal(change)
+	if err != nil {
+		return bk, nil, err
+	}
+	bv := s3.NewBare()
+	bv.Value["Body"] = body
+	bv.Value["ContentType"] = aws.String("application/json")
+	return bk, bv, nil
+}
+
+func (change *changeData) setBare(b *s3.Bare) error {
+	body, ok := b.Value["Body"].([]byte)
+	if !ok {
+		return errors.New("invalid body type")
+	}
+	return json.Unmarshal(body, change)
+}
+
+// watchData is pages and namespaces watched by users.
+type watchData struct {
+	Users map[string]*watcher `json:"users"` // user -> watcher
+}
+
+type watcher struct {
+	Pages      map[string]bool `json:"pages"`      // titleHash
+	Namespaces map[string]bool `json:"namespaces"` // Title prefix
+	Email      string          `json:"email"`
+	Webhook    string          `json:"webhook"`
+}
+
+func (watch *watchData) getBare() (key s3.BareKey, value *s3.Bare, err error) {
+	bk := s3.BareKey{
+		Key: "index/watches.json",
+	}
+
+	body, err := json.Marshal(watch)
+	if err != nil {
+		return bk, nil, err
+	}
+	bv := s3.NewBare()
+	bv.Value["Body"] = body
+	bv.Value["ContentType"] = aws.String("application/json")
+	return bk, bv, nil
+}
+
+func (watch *watchData) setBare(b *s3.Bare) error {
+	body, ok := b.Value["Body"].([]byte)
+	if !ok {
+		return errors.New("invalid body type")
+	}
+	err := json.Unmarshal(body, watch)
+	if err != nil {
+		return err
+	}
+	if watch.Users == nil {
+		watch.Users = make(map[string]*watcher)
+	}
+	return nil
+}
+
+// notificationData is the notifications of a user.
+type notificationData struct {
+	User  string          `json:"user"`  // Key
+	Items []*notification `json:"items"` // From the newest
+}
+
+type notification struct {
+	Change    *changeData     `json:"change"`
+	Read      bool            `json:"read"`
+	Delivered bool            `json:"delivered"`      // Sent by all notifiers
+	Sent      map[string]bool `json:"sent,omitempty"` // Names of notifiers which sent it
+}
+
+func (n *notificationData) getBare() (key s3.BareKey, value *s3.Bare, err error) {
+	bk := s3.BareKey{
+		Key: "notification/" + n.User,
+	}
+
+	body, err := json.Marshal(n)
+	if err != nil {
+		return bk, nil, err
+	}
+	bv := s3.NewBare()
+	bv.Value["Body"] = body
+	bv.Value["ContentType"] = aws.String("application/json")
+	return bk, bv, nil
+}
+
+func (n *notificationData) setBare(b *s3.Bare) error {
+	body, ok := b.Value["Body"].([]byte)
+	if !ok {
+		return errors.New("invalid body type")
+	}
+	return json.Unmarshal(body, n)
+}
+
+// webhookData is outgoing webhooks registered by admins.
+type webhookData struct {
+	Hooks []*webhook `json:"hooks"`
+}
+
+type webhook struct {
+	ID      string    `json:"id"`
+	URL     string    `json:"url"`
+	Secret  string    `json:"secret"` // Key of HMAC signature
+	Events  []string  `json:"events"`
+	Creator string    `json:"creator"`
+	Created time.Time `json:"created"`
+}
+
+func (hooks *webhookData) getBare() (key s3.BareKey, value *s3.Bare, err error) {
+	bk := s3.BareKey{
+		Key: "admin/webhooks.json",
+	}
+
+	body, err := json.Marshal(hooks)
+	if err != nil {
+		return bk, nil, err
+	}
+	bv := s3.NewBare()
+	bv.Value["Body"] = body
+	bv.Value["ContentType"] = aws.String("application/json")
+	return bk, bv, nil
+}
+
+func (hooks *webhookData) setBare(b *s3.Bare) error {
+	body, ok := b.Value["Body"].([]byte)
+	if !ok {
+		return errors.New("invalid body type")
+	}
+	return json.Unmarshal(body, hooks)
+}
+
+// deliveryLogData is the recent deliveries of a webhook.
+type deliveryLogData struct {
+	HookID     string      `json:"hookID"`     // Key
+	Deliveries []*delivery `json:"deliveries"` // From the newest
+
+	Pending []*pendingDelivery `json:"pending,omitempty"` // Waiting for retry
+}
+
+type delivery struct {
+	ID       string        `json:"id"`
+	Event    string        `json:"event"`
+	Time     time.Time     `json:"time"`
+	Attempt  int           `json:"attempt"`
+	Status   int           `json:"status"` // HTTP status, 0 if request failed
+	Error    string        `json:"error"`
+	Duration time.Duration `json:"duration"`
+}
+
+func (dl *deliveryLogData) getBare() (key s3.BareKey, value *s3.Bare, err error) {
+	bk := s3.BareKey{
+		Key: "admin/webhook/" + dl.HookID + "/deliveries.json",
+	}
+
+	body, err := json.Marshal(dl)
+	if err != nil {
+		return bk, nil, err
+	}
+	bv := s3.NewBare()
+	bv.Value["Body"] = body
+	bv.Value["ContentType"] = aws.String("application/json")
+	return bk, bv, nil
+}
+
+func (dl *deliveryLogData) setBare(b *s3.Bare) error {
+	body, ok := b.Value["Body"].([]byte)
+	if !ok {
+		return errors.New("invalid body type")
+	}
+	return json.Unmarshal(body, dl)
+}
+
+// auditData is an entry of the audit log, never updated after it's written.
+type auditData struct {
+	ID        string    `json:"id"` // Key, sorted from the newest
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Actor     string    `json:"actor"`
+	Success   bool      `json:"success"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent"`
+	Target    string    `json:"target"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+func (a *auditData) getBare() (key s3.BareKey, value *s3.Bare, err error) {
+	bk := s3.BareKey{
+		Key: "audit/" + a.ID,
+	}
+
+	body, err := json.Marshal(a)
+	if err != nil {
+		return bk, nil, err
+	}
+	bv := s3.NewBare()
+	bv.Value["Body"] = body
+	bv.Value["ContentType"] = aws.String("application/json")
+	return bk, bv, nil
+}
+
+func (a *auditData) setBare(b *s3.Bare) error {
+	body, ok := b.Value["Body"].([]byte)
+	if !ok {
+		return errors.New("invalid body type")
+	}
+	return json.Unmarshal(body, a)
+}
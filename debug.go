@@ -0,0 +1,17 @@
+//go:build debug
+// +build debug
+
+package main
+
+import (
+	"errors"
+
+	"github.com/labstack/echo"
+)
+
+// addDebugRoutes adds routes only for debug builds (go build -tags debug).
+func addDebugRoutes(e *echo.Echo) {
+	e.GET("/err", func(c echo.Context) (err error) {
+		return errors.New("some error")
+	})
+}
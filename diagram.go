@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	ts3 "github.com/juntaki/transparent/s3"
+	"github.com/pkg/errors"
+	"github.com/russross/blackfriday"
+)
+
+// Diagrams in fenced code blocks are rendered to SVG by diagram-render job after
+// the page is saved, and stored as attachments of the page, named diagram-<hash of source>.svg.
+// Pages including the saved page are rendered again, as their diagrams are stored in them.
+// Views only link them, and show the code if it's not rendered.
+//   ```mermaid        mmdc command (mermaid-cli)
+//   ```plantuml       PlantUML server at PLANTUML_URL
+//   ```graphviz/dot   dot command
+
+const diagramPrefix = "diagram-"
+
+const (
+	diagramTimeout    = 10 * time.Second
+	diagramMaxSize    = 5 * 1024 * 1024
+	diagramMaxPerPage = 20 // Diagrams rendered per page in a run, the rest are rendered next time
+)
+
+type diagramFunc func(ctx context.Context, source []byte) ([]byte, error)
+
+var diagramEngines = map[string]diagramFunc{
+	"mermaid":  renderMermaid,
+	"plantuml": renderPlantUML,
+	"graphviz": renderGraphviz,
+	"dot":      renderGraphviz,
+}
+
+func diagramFilename(lang string, source []byte) string {
+	sum := sha256.Sum256(append([]byte(lang+"\n"), source...))
+	return diagramPrefix + hex.EncodeToString(sum[:16]) + ".svg"
+}
+
+// diagramExists returns true if the SVG is rendered.
+// The result is cached by the filename, which is the hash of the source,
+// so that views don't hit S3 for every diagram.
+func (w *Wikidata) diagramExists(titleHash, filename string) bool {
+	key := ts3.BareKey{Bucket: w.bucket, Key: "page/" + titleHash + "/file/" + filename}
+	if v, ok, _ := w.diagrams.get(key); ok {
+		return v != nil
+	}
+	_, err := w.head(key.Key)
+	if err != nil {
+		if isNotFound(err) {
+			w.diagrams.set(key, nil)
+		} else {
+			log.WithFields(log.Fields{"key": key.Key, "error": err.Error()}).Error("head diagram failed")
+		}
+		return false
+	}
+	// Only existence is cached, not the SVG.
+	w.diagrams.set(key, ts3.NewBare())
+	return true
+}
+
+// renderDiagram renders the SVG as an attachment of the page, if it's not rendered yet.
+func (w *Wikidata) renderDiagram(page *pageData, lang string, source []byte) error {
+	engine, ok := diagramEngines[lang]
+	if !ok {
+		return errors.New("unknown diagram: " + lang)
+	}
+	filename := diagramFilename(lang, source)
+	if w.diagramExists(page.titleHash, filename) {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), diagramTimeout)
+	defer cancel()
+	svg, err := engine(ctx, source)
+	if err != nil {
+		return err
+	}
+	if len(svg) > diagramMaxSize {
+		return errors.New("diagram is too large")
+	}
+
+	file := &fileData{
+		filename:    filename,
+		titleHash:   page.titleHash,
+		filebyte:    svg,
+		contentType: "image/svg+xml",
+	}
+	err = w.saveBare(file)
+	if err != nil {
+		return err
+	}
+	w.diagrams.set(ts3.BareKey{Bucket: w.bucket, Key: "page/" + page.titleHash + "/file/" + filename}, ts3.NewBare())
+	if page.public {
+		return w.publisher.publishFile(file)
+	}
+	return nil
+}
+
+// diagramJob counts diagrams rendered in a render.
+type diagramJob struct {
+	rendered int
+}
+
+// queueDiagrams queues the page and the pages including it to render their diagrams.
+// It's called on save, so that views never run the renderers.
+func (w *Wikidata) queueDiagrams(titleHash string) error {
+	if !w.markdown.diagrams {
+		return nil
+	}
+	includers, err := w.includers(titleHash)
+	if err != nil {
+		return err
+	}
+	w.diagramLock.Lock()
+	defer w.diagramLock.Unlock()
+	if w.diagramQueue == nil {
+		w.diagramQueue = make(map[string]bool)
+	}
+	w.diagramQueue[titleHash] = true
+	for _, includer := range includers {
+		w.diagramQueue[includer] = true
+	}
+	return nil
+}
+
+// renderQueuedDiagrams renders diagrams of the queued pages, for diagram-render job.
+// Public pages with new diagrams are published again.
+func (w *Wikidata) renderQueuedDiagrams() error {
+	w.diagramLock.Lock()
+	queue := w.diagramQueue
+	w.diagramQueue = nil
+	w.diagramLock.Unlock()
+
+	var lastErr error
+	for titleHash := range queue {
+		page := &pageData{titleHash: titleHash}
+		err := w.loadBare(page)
+		if err != nil {
+			// Deleted after saved.
+			continue
+		}
+		page.public = w.checkPublic(titleHash)
+		job := &diagramJob{}
+		w.render(page, w.pageLink, nil, job)
+		if job.rendered > 0 && page.public {
+			err = w.publishPage(page)
+			if err != nil {
+				log.WithFields(log.Fields{"titleHash": titleHash, "error": err.Error()}).Error("publish diagrams failed")
+				lastErr = err
+			}
+		}
+	}
+	return lastErr
+}
+
+func runDiagramCommand(ctx context.Context, source []byte, name string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = bytes.NewReader(source)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrap(err, name+": "+stderr.String())
+	}
+	return out, nil
+}
+
+func renderGraphviz(ctx context.Context, source []byte) ([]byte, error) {
+	return runDiagramCommand(ctx, source, "dot", "-Tsvg")
+}
+
+func renderMermaid(ctx context.Context, source []byte) ([]byte, error) {
+	dir, err := ioutil.TempDir("", "bucketwiki")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "diagram.mmd")
+	output := filepath.Join(dir, "diagram.svg")
+	err = ioutil.WriteFile(input, source, 0600)
+	if err != nil {
+		return nil, err
+	}
+	_, err = runDiagramCommand(ctx, nil, "mmdc", "-i", input, "-o", output)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(output)
+}
+
+// plantUMLURL is the PlantUML server, set by config.
+var plantUMLURL string
+
+var plantUMLClient = &http.Client{Timeout: diagramTimeout}
+
+// plantUMLEncoding is base64 of PlantUML, with its own alphabet.
+var plantUMLEncoding = base64.NewEncoding("0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz-_").WithPadding(base64.NoPadding)
+
+// encodePlantUML encodes the source for URL of PlantUML server, deflated and base64 encoded.
+func encodePlantUML(source []byte) (string, error) {
+	var buf bytes.Buffer
+	zw, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	_, err = zw.Write(source)
+	if err != nil {
+		return "", err
+	}
+	err = zw.Close()
+	if err != nil {
+		return "", err
+	}
+	// PlantUML pads the last group with zero, instead of "=".
+	for buf.Len()%3 != 0 {
+		buf.WriteByte(0)
+	}
+	return plantUMLEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+func renderPlantUML(ctx context.Context, source []byte) ([]byte, error) {
+	server := plantUMLURL
+	if server == "" {
+		return nil, errors.New("PLANTUML_URL is not set")
+	}
+	encoded, err := encodePlantUML(source)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", server+"/svg/"+encoded, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := plantUMLClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("plantuml server returns %d", resp.StatusCode)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, diagramMaxSize+1))
+}
+
+// diagramRenderer renders fenced code blocks of diagrams as images.
+// Other code blocks, or diagrams not rendered are passed to Renderer.
+// If job is not nil, diagrams not rendered yet are rendered, up to diagramMaxPerPage.
+type diagramRenderer struct {
+	blackfriday.Renderer
+	w       *Wikidata
+	page    *pageData
+	job     *diagramJob
+	rewrite urlRewriter
+}
+
+func (r *diagramRenderer) BlockCode(out *bytes.Buffer, text []byte, info string) {
+	lang := strings.ToLower(parseCodeOptions(info).lang)
+	titleHash := r.page.titleHash
+	if _, ok := diagramEngines[lang]; !ok || titleHash == "" {
+		r.Renderer.BlockCode(out, text, info)
+		return
+	}
+
+	filename := diagramFilename(lang, text)
+	if !r.w.diagramExists(titleHash, filename) {
+		if r.job == nil || r.job.rendered >= diagramMaxPerPage {
+			r.Renderer.BlockCode(out, text, info)
+			return
+		}
+		r.job.rendered++
+		err := r.w.renderDiagram(r.page, lang, text)
+		if err != nil {
+			log.WithFields(log.Fields{"titleHash": titleHash, "lang": lang, "error": err.Error()}).Warn("diagram failed")
+			r.Renderer.BlockCode(out, text, info)
+			return
+		}
+	}
+	if out.Len() > 0 {
+		out.WriteByte('\n')
+	}
+	src := "/page/" + titleHash + "/file/" + filename
+	if r.rewrite != nil {
+		src = r.rewrite(src)
+	}
+	out.WriteString(`<p><img class="diagram" src="` + src + `" alt="` + lang + ` diagram"></p>` + "\n")
+}
@@ -3,30 +3,61 @@ package main
 import (
 	"io/ioutil"
 	"net/http"
-	"reflect"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/labstack/echo"
 )
 
 func (h *handler) editorHandler(c echo.Context) (err error) {
 	titleHash := c.Param("titleHash")
 	title := c.QueryParam("title")
-	body := "# " + title + "\n"
 
 	md := &pageData{
 		titleHash: titleHash,
 	}
-	err = h.db.loadBare(md)
+	err = h.db.with(c).loadBare(md)
 	if err == nil {
-		body = md.body
+		return c.Render(http.StatusOK, "edit.html", map[string]interface{}{
+			"Title":     title,
+			"TitleHash": titleHash,
+			"Body":      md.body,
+		})
+	}
+
+	// New page is created from the template.
+	templates, err := h.db.listTemplates()
+	if err != nil {
+		logger(c).WithField("error", err.Error()).Warn("list templates failed")
+	}
+	var selected *pageTemplate
+	if name, ok := c.QueryParams()["template"]; ok {
+		for _, t := range templates {
+			if t.Name == name[0] {
+				selected = t
+			}
+		}
+	} else if !isTemplate(title) {
+		selected = defaultTemplate(templates, title)
+	}
+
+	body := "# " + title + "\n"
+	if selected != nil {
+		tmpl := &pageData{titleHash: selected.TitleHash}
+		err = h.db.with(c).loadBare(tmpl)
+		if err != nil {
+			return err
+		}
+		sess := c.Get("session").(*sessionData)
+		body = expandTemplate(tmpl.body, title, sess.User, time.Now())
 	}
 	return c.Render(http.StatusOK, "edit.html", map[string]interface{}{
 		"Title":     title,
 		"TitleHash": titleHash,
 		"Body":      body,
+		"New":       true,
+		"Templates": templates,
+		"Selected":  selected,
 	})
 }
 
@@ -36,6 +67,9 @@ func (h *handler) uploadHandler(c echo.Context) (err error) {
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err)
 	}
+	if header.Size > h.db.config.Limits.MaxUploadSize {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "file is too large")
+	}
 	filename := header.Filename
 	contentType := header.Header["Content-Type"][0]
 
@@ -52,13 +86,37 @@ func (h *handler) uploadHandler(c echo.Context) (err error) {
 		contentType: contentType,
 		filebyte:    body,
 	}
-	err = h.db.saveBare(fileData)
-	return echo.NewHTTPError(http.StatusInternalServerError, err)
+	err = h.db.with(c).saveBare(fileData)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err)
+	}
+	metrics.uploadBytes.add("", float64(len(body)))
+	if h.db.checkPublic(titleHash) {
+		err = h.db.publisher.publishFile(fileData)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err)
+		}
+	}
+
+	sess := c.Get("session").(*sessionData)
+	titles, err := h.db.titles()
+	if err != nil {
+		logger(c).WithField("error", err.Error()).Warn("load titles failed")
+	}
+	h.db.dispatchWebhooks(&webhookEvent{
+		Event:     eventFileUploaded,
+		Time:      time.Now(),
+		User:      sess.User,
+		Title:     titles[titleHash],
+		TitleHash: titleHash,
+		URL:       fileURL(h.db.config.URL, titleHash, filename),
+		Filename:  filename,
+	})
+	return c.NoContent(http.StatusOK)
 }
 
 func (h *handler) postPageHandler(c echo.Context) (err error) {
 	method := c.FormValue("_method")
-	log.Println(method)
 	switch method {
 	case "put":
 		return h.putPageHandler(c)
@@ -71,16 +129,46 @@ func (h *handler) postPageHandler(c echo.Context) (err error) {
 func (h *handler) deletePageHandler(c echo.Context) (err error) {
 	titleHash := c.Param("titleHash")
 	md := &pageData{titleHash: titleHash}
-	html := &htmlData{titleHash: titleHash}
+	err = h.db.with(c).loadBare(md)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "page not found")
+	}
 
-	err = h.db.deleteBare(md)
+	err = h.db.with(c).deleteBare(md)
+	if err != nil {
+		return err
+	}
+	h.db.setPageExists(titleHash, false)
+	err = h.db.setPageTitle(titleHash, "")
+	if err != nil {
+		return err
+	}
+	err = h.db.setIncludes(titleHash, "")
+	if err != nil {
+		return err
+	}
+	err = h.db.setTags(titleHash, "")
+	if err != nil {
+		return err
+	}
+	err = h.db.setMeta(titleHash, nil)
 	if err != nil {
 		return err
 	}
-	err = h.db.deleteBare(html)
+	err = h.db.unpublishPage(titleHash)
 	if err != nil {
 		return err
 	}
+
+	sess := c.Get("session").(*sessionData)
+	h.db.recordChange(&changeData{
+		User:      sess.User,
+		Action:    changeDelete,
+		TitleHash: titleHash,
+		Title:     md.title,
+		Summary:   c.FormValue("summary"),
+	})
+	h.audit(c, &auditData{Action: auditDelete, Target: md.title, Success: true})
 	return c.Redirect(http.StatusFound, "/")
 }
 
@@ -88,54 +176,99 @@ func (h *handler) putPageHandler(c echo.Context) (err error) {
 	titleHash := c.Param("titleHash")
 	title := c.FormValue("title")
 	if titleHash != h.db.titleHash(title) {
-		log.Println("title not match")
-		log.Println("title:", title)
-		log.Println("generated:", h.db.titleHash(title))
-		log.Println("titleHash:", titleHash)
+		logger(c).WithFields(log.Fields{
+			"title":     title,
+			"titleHash": titleHash,
+		}).Warn("title not match")
 		return c.Redirect(http.StatusFound, "/500")
 	}
 
+	body := c.FormValue("body")
+	if int64(len(body)) > h.db.config.Limits.MaxPageSize {
+		return h.editError(c, http.StatusRequestEntityTooLarge, "page is too large")
+	}
+	meta, rest, err := parseFrontMatter(body)
+	if err != nil {
+		return h.editError(c, http.StatusBadRequest, err.Error())
+	}
+	if rest == body {
+		// No front-matter
+		meta = nil
+	}
+
 	sess := c.Get("session").(*sessionData)
 
 	public := h.db.checkPublic(titleHash)
+	action := changeEdit
+	if !h.db.pageExists(titleHash) {
+		action = changeCreate
+	}
 
 	// Upload markdown
 	markdown := &pageData{
 		titleHash:  titleHash,
 		title:      title,
 		author:     sess.User,
-		body:       c.FormValue("body"),
+		body:       body,
 		lastUpdate: time.Now(),
 		public:     public,
 	}
 
-	err = h.db.saveBare(markdown)
+	err = h.db.with(c).saveBare(markdown)
+	if err != nil {
+		logger(c).WithField("error", err.Error()).Error("save page failed")
+		status := http.StatusInternalServerError
+		if isTransient(err) {
+			status = http.StatusServiceUnavailable
+		}
+		return h.editError(c, status, "Failed to save the page, please try again: "+err.Error())
+	}
+	h.db.setPageExists(titleHash, true)
+	err = h.db.setPageTitle(titleHash, title)
+	if err != nil {
+		return err
+	}
+	err = h.db.setIncludes(titleHash, markdown.body)
+	if err != nil {
+		return err
+	}
+	err = h.db.setTags(titleHash, markdown.body)
+	if err != nil {
+		return err
+	}
+	err = h.db.setMeta(titleHash, meta)
+	if err != nil {
+		return err
+	}
+	err = h.db.queueDiagrams(titleHash)
 	if err != nil {
 		return err
 	}
 
 	if public {
-		err = h.db.setACL(titleHash, true)
+		err = h.db.publishPage(markdown)
 		if err != nil {
 			return err
 		}
 	}
+
+	h.db.recordChange(&changeData{
+		User:      sess.User,
+		Action:    action,
+		TitleHash: titleHash,
+		Title:     title,
+		Summary:   c.FormValue("summary"),
+	})
 	return c.Redirect(http.StatusFound, "/page/"+titleHash)
 }
 
-func (w *Wikidata) uploadHTML(markdown *pageData) error {
-	html := &htmlData{
-		titleHash: markdown.titleHash,
-		body:      string(w.renderHTML(markdown)),
-	}
-	err := w.saveBare(html)
-	if err != nil {
-		return err
-	}
-	w.cacheStack[reflect.TypeOf(htmlData{})].Sync()
-	err = w.putacl(html.getKey(), s3.ObjectCannedACLPublicRead)
-	if err != nil {
-		return err
-	}
-	return nil
+// editError shows the editor again with the error, keeping the unsaved text.
+func (h *handler) editError(c echo.Context, status int, message string) error {
+	return c.Render(status, "edit.html", map[string]interface{}{
+		"Title":     c.FormValue("title"),
+		"TitleHash": c.Param("titleHash"),
+		"Body":      c.FormValue("body"),
+		"Summary":   c.FormValue("summary"),
+		"Error":     message,
+	})
 }
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Page may start with YAML front-matter, which is not rendered.
+//   ---
+//   owner: alice
+//   status: draft
+//   review-date: 2017-01-31
+//   tags: [ops, on-call]
+//   team: infra        <- custom field
+//   ---
+
+const reviewDateFormat = "2006-01-02"
+
+type frontMatter struct {
+	Owner      string                 `yaml:"owner" json:"owner,omitempty"`
+	Status     string                 `yaml:"status" json:"status,omitempty"`
+	ReviewDate string                 `yaml:"review-date" json:"review-date,omitempty"`
+	Tags       tagList                `yaml:"tags" json:"tags,omitempty"`
+	Fields     map[string]interface{} `yaml:",inline" json:"fields,omitempty"`
+}
+
+// tagList accepts both of "tags: [a, b]" and "tags: a, b"
+type tagList []string
+
+func (t *tagList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []string
+	if err := unmarshal(&list); err == nil {
+		*t = list
+		return nil
+	}
+	var str string
+	if err := unmarshal(&str); err != nil {
+		return err
+	}
+	*t = nil
+	for _, tag := range strings.Split(str, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			*t = append(*t, tag)
+		}
+	}
+	return nil
+}
+
+// splitFrontMatter returns the front-matter and the rest of body.
+// The leading block is front-matter only if it's a YAML mapping,
+// otherwise it's a horizontal rule and a setext heading or so.
+func splitFrontMatter(body string) (string, string) {
+	normalized := strings.Replace(body, "\r\n", "\n", -1)
+	if !strings.HasPrefix(normalized, "---\n") {
+		return "", body
+	}
+	lines := strings.SplitAfter(normalized, "\n")
+	for i := 1; i < len(lines); i++ {
+		if line := strings.TrimSpace(lines[i]); line == "---" || line == "..." {
+			str := strings.Join(lines[1:i], "")
+			var m yaml.MapSlice
+			if yaml.Unmarshal([]byte(str), &m) != nil || len(m) == 0 {
+				return "", body
+			}
+			return str, strings.Join(lines[i+1:], "")
+		}
+	}
+	// Not closed, it's a horizontal rule.
+	return "", body
+}
+
+// parseFrontMatter parses the front-matter of body, and returns the rest.
+func parseFrontMatter(body string) (*frontMatter, string, error) {
+	meta := &frontMatter{}
+	str, rest := splitFrontMatter(body)
+	if str == "" {
+		return meta, rest, nil
+	}
+
+	err := yaml.Unmarshal([]byte(str), meta)
+	if err != nil {
+		return meta, rest, errors.Wrap(err, "invalid front-matter")
+	}
+	if meta.ReviewDate != "" {
+		_, err = time.Parse(reviewDateFormat, meta.ReviewDate)
+		if err != nil {
+			return meta, rest, errors.New("invalid front-matter: review-date should be " + reviewDateFormat)
+		}
+	}
+	for key, value := range meta.Fields {
+		meta.Fields[key] = normalizeYAML(value)
+	}
+	return meta, rest, nil
+}
+
+// normalizeYAML converts maps of YAML into map[string]interface{}, for JSON.
+func normalizeYAML(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{})
+		for key, elem := range v {
+			m[fmt.Sprint(key)] = normalizeYAML(elem)
+		}
+		return m
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = normalizeYAML(elem)
+		}
+	}
+	return value
+}
+
+// reviewOverdue returns true if review-date is passed.
+func (meta *frontMatter) reviewOverdue(now time.Time) bool {
+	date, err := time.Parse(reviewDateFormat, meta.ReviewDate)
+	return err == nil && now.Format(reviewDateFormat) > date.Format(reviewDateFormat)
+}
+
+// property returns the value of the property by name, as string.
+func (meta *frontMatter) property(name string) (string, bool) {
+	switch name {
+	case "owner":
+		return meta.Owner, meta.Owner != ""
+	case "status":
+		return meta.Status, meta.Status != ""
+	case "review-date":
+		return meta.ReviewDate, meta.ReviewDate != ""
+	case "tags":
+		return strings.Join(meta.Tags, ","), len(meta.Tags) > 0
+	}
+	value, ok := meta.Fields[name]
+	if !ok {
+		return "", false
+	}
+	return fmt.Sprint(value), true
+}
+
+// matches returns true if all filters match the properties.
+// Tags filter matches one of tags.
+func (meta *frontMatter) matches(filters map[string]string) bool {
+	for name, expected := range filters {
+		if name == "tags" || name == "tag" {
+			found := false
+			for _, tag := range meta.Tags {
+				found = found || strings.EqualFold(tag, expected)
+			}
+			if !found {
+				return false
+			}
+			continue
+		}
+		value, ok := meta.property(name)
+		if !ok || !strings.EqualFold(value, expected) {
+			return false
+		}
+	}
+	return true
+}
+
+// pageMetaHandler returns the properties of the page as JSON.
+func (h *handler) pageMetaHandler(c echo.Context) (err error) {
+	md := &pageData{titleHash: c.Param("titleHash")}
+	err = h.db.with(c).loadBare(md)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "page not found")
+	}
+	meta, _, err := parseFrontMatter(md.body)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"title":      md.title,
+		"titleHash":  md.titleHash,
+		"author":     md.author,
+		"lastUpdate": md.lastUpdate,
+		"properties": meta,
+	})
+}
+
+type pageProperties struct {
+	Title     string
+	TitleHash string
+	Meta      *frontMatter
+}
+
+// pagesHandler lists pages filtered by properties, like /pages?status=draft&owner=alice
+// With format=json, the list is returned as JSON.
+func (h *handler) pagesHandler(c echo.Context) (err error) {
+	filters := make(map[string]string)
+	for name, values := range c.QueryParams() {
+		if name != "format" {
+			filters[name] = values[0]
+		}
+	}
+
+	h.db.indexLock.Lock()
+	index, err := h.db.loadMetaIndex()
+	h.db.indexLock.Unlock()
+	if err != nil {
+		return err
+	}
+	titles, err := h.db.titles()
+	if err != nil {
+		return err
+	}
+
+	var pages []*pageProperties
+	for titleHash, meta := range index.Pages {
+		title, ok := titles[titleHash]
+		if ok && meta.matches(filters) {
+			pages = append(pages, &pageProperties{
+				Title:     title,
+				TitleHash: titleHash,
+				Meta:      meta,
+			})
+		}
+	}
+	sort.Slice(pages, func(i, j int) bool {
+		return pages[i].Title < pages[j].Title
+	})
+
+	if c.QueryParam("format") == "json" {
+		return c.JSON(http.StatusOK, pages)
+	}
+	return c.Render(http.StatusOK, "pages.html", map[string]interface{}{
+		"Filters": filters,
+		"Pages":   pages,
+	})
+}
+
+func (w *Wikidata) loadMetaIndex() (*metaIndexData, error) {
+	index := &metaIndexData{}
+	err := w.loadBare(index)
+	if err == nil {
+		return index, nil
+	}
+
+	// First access or broken index, scan pages to recover it.
+	log.WithField("error", err.Error()).Warn("meta index not found, rebuild")
+	index.Pages = make(map[string]*frontMatter)
+	err = w.forEachPage(func(markdown *pageData) {
+		meta, rest, err := parseFrontMatter(markdown.body)
+		if err == nil && rest != markdown.body {
+			index.Pages[markdown.titleHash] = meta
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = w.saveBare(index)
+	if err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// setMeta updates the meta index. nil meta removes the page.
+func (w *Wikidata) setMeta(titleHash string, meta *frontMatter) error {
+	w.indexLock.Lock()
+	defer w.indexLock.Unlock()
+
+	index, err := w.loadMetaIndex()
+	if err != nil {
+		return err
+	}
+	w.indexUpdated(titleHash)
+	_, found := index.Pages[titleHash]
+	if meta == nil && !found {
+		return nil
+	}
+	if meta == nil {
+		delete(index.Pages, titleHash)
+	} else {
+		index.Pages[titleHash] = meta
+	}
+	return w.saveBare(index)
+}
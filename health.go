@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/labstack/echo"
+)
+
+// /healthz is ok while the process is up, for liveness probe.
+// /readyz checks the bucket and templates, for readiness probe.
+// The result is cached for readyTTL, so that probes don't hit S3 every time.
+// Probes are unauthenticated, so the response has only ok or fail of each check,
+// and the reason of failure is logged.
+
+const readyTTL = 5 * time.Second
+
+type readiness struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"` // name -> "ok" or "fail"
+}
+
+var (
+	readyLock    sync.Mutex
+	readyResult  *readiness
+	readyChecked time.Time
+)
+
+// checkReady checks S3 is reachable, the bucket is versioned and templates are loaded.
+func (w *Wikidata) checkReady() *readiness {
+	r := &readiness{Ready: true, Checks: make(map[string]string)}
+	fail := func(name, message string) {
+		r.Ready = false
+		r.Checks[name] = "fail"
+		log.WithFields(log.Fields{"check": name, "error": message}).Error("not ready")
+	}
+
+	_, err := w.svc.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(w.bucket)})
+	if err != nil {
+		fail("storage", err.Error())
+	} else {
+		r.Checks["storage"] = "ok"
+	}
+
+	versioning, err := w.svc.GetBucketVersioning(&s3.GetBucketVersioningInput{Bucket: aws.String(w.bucket)})
+	switch {
+	case err != nil:
+		fail("versioning", err.Error())
+	case versioning.Status == nil || *versioning.Status != s3.BucketVersioningStatusEnabled:
+		// History of pages needs versioning.
+		fail("versioning", "bucket versioning is not enabled")
+	default:
+		r.Checks["versioning"] = "ok"
+	}
+
+	if w.templates == nil || w.templates.Lookup("view.html") == nil {
+		fail("templates", "templates are not loaded")
+	} else {
+		r.Checks["templates"] = "ok"
+	}
+	return r
+}
+
+func (h *handler) healthzHandler(c echo.Context) (err error) {
+	return c.String(http.StatusOK, "ok")
+}
+
+func (h *handler) readyzHandler(c echo.Context) (err error) {
+	readyLock.Lock()
+	if readyResult == nil || time.Since(readyChecked) > readyTTL {
+		readyResult = h.db.checkReady()
+		readyChecked = time.Now()
+	}
+	r := readyResult
+	readyLock.Unlock()
+
+	status := http.StatusOK
+	if !r.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	return c.JSON(status, r)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// Titles separated by "/" form a hierarchy, like "Team/Meeting/2016-12-01".
+// Parent pages are not required to exist.
+
+const titleSeparator = "/"
+
+type pageNode struct {
+	Name      string // Last element of the title
+	Title     string
+	TitleHash string
+	Exists    bool
+	Open      bool // Ancestor of the current page, or the current page
+	Current   bool
+	Children  []*pageNode
+}
+
+// titlePath returns the titles from the top ancestor to the page,
+// "A/B/C" -> ["A", "A/B", "A/B/C"]
+func titlePath(title string) []string {
+	var result []string
+	for i, c := range title {
+		if string(c) == titleSeparator && i > 0 {
+			result = append(result, title[:i])
+		}
+	}
+	return append(result, title)
+}
+
+func parentTitle(title string) string {
+	i := strings.LastIndex(title, titleSeparator)
+	if i <= 0 {
+		return ""
+	}
+	return title[:i]
+}
+
+func (w *Wikidata) pageNode(title string) *pageNode {
+	parent := parentTitle(title)
+	name := title
+	if parent != "" {
+		name = title[len(parent)+len(titleSeparator):]
+	}
+	return &pageNode{
+		Name:      name,
+		Title:     title,
+		TitleHash: w.titleHash(title),
+	}
+}
+
+// breadcrumb returns the ancestors of the page.
+func (w *Wikidata) breadcrumb(title string) []*pageNode {
+	var result []*pageNode
+	path := titlePath(title)
+	for _, t := range path[:len(path)-1] {
+		node := w.pageNode(t)
+		node.Exists = w.pageExists(node.TitleHash)
+		result = append(result, node)
+	}
+	return result
+}
+
+// pageTree builds the tree of titles, which is opened to the current page.
+// It returns the top level pages, and the node of the current page.
+func (w *Wikidata) pageTree(titles map[string]string, current string) ([]*pageNode, *pageNode) {
+	root := &pageNode{}
+	nodes := map[string]*pageNode{"": root}
+	var find func(title string) *pageNode
+	find = func(title string) *pageNode {
+		if node, ok := nodes[title]; ok {
+			return node
+		}
+		node := w.pageNode(title)
+		nodes[title] = node
+		parent := find(parentTitle(title))
+		parent.Children = append(parent.Children, node)
+		return node
+	}
+
+	for _, title := range titles {
+		find(title).Exists = true
+	}
+	for _, title := range titlePath(current) {
+		find(title).Open = true
+	}
+	node := find(current)
+	node.Current = true
+
+	for _, n := range nodes {
+		sort.Slice(n.Children, func(i, j int) bool {
+			return n.Children[i].Name < n.Children[j].Name
+		})
+	}
+	return root.Children, node
+}
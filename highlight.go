@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/chroma"
+	chromahtml "github.com/alecthomas/chroma/formatters/html"
+	"github.com/alecthomas/chroma/lexers"
+	"github.com/alecthomas/chroma/styles"
+	"github.com/labstack/echo"
+	"github.com/russross/blackfriday"
+)
+
+// Fenced code block is highlighted by the language, with chroma.
+// Line numbers and highlighted lines are set by the options like
+//   ``` {.go .linenos hl=2,4-5}
+// Tokens are marked by classes with highlightPrefix, such as hl-k (keyword).
+// The style is generated once as highlightCSS, which is served at
+// /highlight.css and published with public pages.
+
+const highlightPrefix = "hl-"
+
+var highlightStyle = styles.Get("github")
+
+var highlightCSS = func() []byte {
+	var buf bytes.Buffer
+	err := chromahtml.New(chromahtml.WithClasses(true), chromahtml.ClassPrefix(highlightPrefix)).WriteCSS(&buf, highlightStyle)
+	if err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}()
+
+func highlightCSSHandler(c echo.Context) error {
+	return c.Blob(http.StatusOK, "text/css", highlightCSS)
+}
+
+func findLexer(lang string) chroma.Lexer {
+	l := lexers.Get(lang)
+	if l == nil {
+		l = lexers.Fallback
+	}
+	return chroma.Coalesce(l)
+}
+
+type codeOptions struct {
+	lang        string
+	lineNumbers bool
+	highlight   [][2]int // Ranges of highlighted lines
+}
+
+// parseCodeOptions parses the info string of fenced code block, like ".go .linenos hl=2,4-5"
+func parseCodeOptions(info string) codeOptions {
+	opts := codeOptions{}
+	for _, elt := range strings.Fields(info) {
+		elt = strings.TrimPrefix(elt, ".")
+		switch {
+		case elt == "linenos":
+			opts.lineNumbers = true
+		case strings.HasPrefix(elt, "hl="):
+			for _, r := range strings.Split(elt[3:], ",") {
+				bounds := strings.SplitN(r, "-", 2)
+				from, err := strconv.Atoi(bounds[0])
+				if err != nil {
+					continue
+				}
+				to := from
+				if len(bounds) == 2 {
+					to, err = strconv.Atoi(bounds[1])
+					if err != nil {
+						continue
+					}
+				}
+				opts.highlight = append(opts.highlight, [2]int{from, to})
+			}
+		case opts.lang == "" && elt != "":
+			opts.lang = elt
+		}
+	}
+	return opts
+}
+
+func writeHighlightedCode(out *bytes.Buffer, code []byte, opts codeOptions) {
+	formatter := chromahtml.New(
+		chromahtml.WithClasses(true),
+		chromahtml.ClassPrefix(highlightPrefix),
+		chromahtml.WithLineNumbers(opts.lineNumbers),
+		chromahtml.HighlightLines(opts.highlight),
+	)
+	iterator, err := findLexer(opts.lang).Tokenise(nil, string(code))
+	if err == nil {
+		var buf bytes.Buffer
+		err = formatter.Format(&buf, highlightStyle, iterator)
+		if err == nil {
+			out.Write(buf.Bytes())
+			out.WriteByte('\n')
+			return
+		}
+	}
+	out.WriteString(`<pre><code>` + html.EscapeString(string(code)) + "</code></pre>\n")
+}
+
+// highlightRenderer renders fenced code blocks with syntax highlighting.
+type highlightRenderer struct {
+	blackfriday.Renderer
+}
+
+func (r *highlightRenderer) BlockCode(out *bytes.Buffer, text []byte, lang string) {
+	if out.Len() > 0 {
+		out.WriteByte('\n')
+	}
+	writeHighlightedCode(out, text, parseCodeOptions(lang))
+}
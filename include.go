@@ -0,0 +1,158 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// {{include:Title}} or [[!Title]] embeds the markdown of another page.
+// Only pages which can be linked from the rendering page are included,
+// so private pages are never included into public or shared pages.
+
+// Limits of includes per render, so that repeated includes can't make rendering slow.
+const (
+	includeMaxDepth      = 5
+	includeMaxExpansions = 50
+	includeMaxBytes      = 1 << 20
+)
+
+var includeRegexp = regexp.MustCompile(`\{\{include:(.*?)\}\}|\[\[!(.*?)\]\]`)
+
+// parseIncludes returns titles of includes outside of code.
+func parseIncludes(body string) []string {
+	var titles []string
+	mapOutsideCode(body, func(text string) string {
+		for _, m := range includeRegexp.FindAllStringSubmatch(text, -1) {
+			titles = append(titles, strings.TrimSpace(m[1]+m[2]))
+		}
+		return text
+	})
+	return titles
+}
+
+// includeBudget is the rest of expansions and bytes in a render.
+type includeBudget struct {
+	expansions int
+	bytes      int
+}
+
+// expandIncludes replaces includes in body recursively.
+// stack is titleHash of the including pages, to detect loops.
+func (w *Wikidata) expandIncludes(body string, resolve linkResolver, stack []string) string {
+	return w.expand(body, resolve, stack, &includeBudget{expansions: includeMaxExpansions, bytes: includeMaxBytes})
+}
+
+func (w *Wikidata) expand(body string, resolve linkResolver, stack []string, budget *includeBudget) string {
+	return mapOutsideCode(body, func(text string) string {
+		return includeRegexp.ReplaceAllStringFunc(text, func(a string) string {
+			m := includeRegexp.FindStringSubmatch(a)
+			title := strings.TrimSpace(m[1] + m[2])
+			link := wikiLink{title: title, label: title}
+			if _, state := resolve(title); state != linkExists {
+				return link.render(resolve)
+			}
+
+			titleHash := w.titleHash(title)
+			for _, including := range stack {
+				if including == titleHash {
+					return "*Include loop: " + link.render(resolve) + "*"
+				}
+			}
+			if len(stack) > includeMaxDepth {
+				return "*Include is too deep: " + link.render(resolve) + "*"
+			}
+			if budget.expansions <= 0 {
+				return "*Too many includes: " + link.render(resolve) + "*"
+			}
+			budget.expansions--
+
+			md := &pageData{titleHash: titleHash}
+			err := w.loadBare(md)
+			if err != nil {
+				return link.render(resolve)
+			}
+			_, body := splitFrontMatter(md.body)
+			if len(body) > budget.bytes {
+				budget.bytes = 0
+				return "*Too many includes: " + link.render(resolve) + "*"
+			}
+			budget.bytes -= len(body)
+			return "\n" + w.expand(body, resolve, append(stack, titleHash), budget) + "\n"
+		})
+	})
+}
+
+func (w *Wikidata) loadIncludeIndex() (*includeIndexData, error) {
+	index := &includeIndexData{}
+	err := w.loadBare(index)
+	if err == nil {
+		return index, nil
+	}
+
+	// First access or broken index, scan pages to recover it.
+	log.WithField("error", err.Error()).Warn("include index not found, rebuild")
+	index.Includers = make(reverseIndex)
+	err = w.forEachPage(func(markdown *pageData) {
+		index.Includers.set(markdown.titleHash, w.includedHashes(markdown.body))
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = w.saveBare(index)
+	if err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+func (w *Wikidata) includedHashes(body string) []string {
+	var result []string
+	for _, title := range parseIncludes(body) {
+		result = append(result, w.titleHash(title))
+	}
+	return result
+}
+
+// setIncludes updates the include index with the new body of the page.
+func (w *Wikidata) setIncludes(titleHash, body string) error {
+	w.indexLock.Lock()
+	defer w.indexLock.Unlock()
+
+	index, err := w.loadIncludeIndex()
+	if err != nil {
+		return err
+	}
+	w.indexUpdated(titleHash)
+	if index.Includers.set(titleHash, w.includedHashes(body)) {
+		return w.saveBare(index)
+	}
+	return nil
+}
+
+// includers returns the pages including the page, directly or indirectly.
+func (w *Wikidata) includers(titleHash string) ([]string, error) {
+	w.indexLock.Lock()
+	index, err := w.loadIncludeIndex()
+	w.indexLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	visited := map[string]bool{titleHash: true}
+	queue := []string{titleHash}
+	for len(queue) > 0 {
+		included := queue[0]
+		queue = queue[1:]
+		for includer := range index.Includers[included] {
+			if !visited[includer] {
+				visited[includer] = true
+				result = append(result, includer)
+				queue = append(queue, includer)
+			}
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	ts3 "github.com/juntaki/transparent/s3"
+)
+
+// Every instance has its own caches, so writes are published to the others
+// by invalidator, and they drop the cache entries of the object.
+// CACHE_INVALIDATION selects it, "none" (default, for a single instance),
+// "memory" or "s3". s3 puts an empty marker object
+//   invalidation/<inverted time>-<origin>-<random>/<cache name>/<key>
+// and every instance polls them each CACHE_INVALIDATION_INTERVAL, by cache-invalidation job.
+
+type invalidation struct {
+	Origin string // instanceID of the writer
+	Cache  string // cacheName of the type
+	Key    string
+}
+
+type invalidator interface {
+	publish(inv invalidation) error
+	subscribe(f func(inv invalidation))
+}
+
+const (
+	invalidationPrefix = "invalidation/"
+	invalidationWindow = time.Minute // Allowed clock skew between instances
+)
+
+func newInvalidator(w *Wikidata, kind string) (invalidator, error) {
+	switch kind {
+	case "", "none":
+		return nil, nil
+	case "memory":
+		return &memoryInvalidator{}, nil
+	case "s3":
+		return &s3Invalidator{
+			svc:    w.svc,
+			bucket: w.bucket,
+			seen:   make(map[string]time.Time),
+			since:  time.Now(),
+		}, nil
+	}
+	return nil, errors.New("unknown cache invalidation: " + kind)
+}
+
+// setInvalidator publishes writes of this instance, and subscribes others.
+func (w *Wikidata) setInvalidator(inv invalidator) error {
+	id, err := randomString()
+	if err != nil {
+		return err
+	}
+	w.instanceID = id[:16]
+	w.invalidator = inv
+	inv.subscribe(w.applyInvalidation)
+	return nil
+}
+
+// invalidate publishes the write of the key.
+// Failure is only logged, other instances are updated after TTL.
+func (s *storageCall) invalidate(name string, key ts3.BareKey) {
+	if s.invalidator == nil || key.VersionId != "" {
+		return
+	}
+	err := s.invalidator.publish(invalidation{
+		Origin: s.instanceID,
+		Cache:  name,
+		Key:    key.Key,
+	})
+	if err != nil {
+		s.log.WithFields(log.Fields{"cache": name, "key": key.Key, "error": err.Error()}).Error("publish invalidation failed")
+	}
+}
+
+func (w *Wikidata) applyInvalidation(inv invalidation) {
+	if inv.Origin == w.instanceID {
+		return
+	}
+	for t, c := range w.caches {
+		if cacheName(t) == inv.Cache {
+			c.invalidate(ts3.BareKey{Bucket: w.bucket, Key: inv.Key})
+		}
+	}
+	if inv.Cache == "page" {
+		// The page may be created or deleted, reload the list lazily.
+		w.pagesLock.Lock()
+		w.pages = nil
+		w.pagesLock.Unlock()
+	}
+}
+
+// memoryInvalidator delivers invalidations in the process, for tests.
+type memoryInvalidator struct {
+	lock        sync.Mutex
+	subscribers []func(inv invalidation)
+}
+
+func (m *memoryInvalidator) publish(inv invalidation) error {
+	m.lock.Lock()
+	subscribers := m.subscribers
+	m.lock.Unlock()
+	for _, f := range subscribers {
+		f(inv)
+	}
+	return nil
+}
+
+func (m *memoryInvalidator) subscribe(f func(inv invalidation)) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.subscribers = append(m.subscribers, f)
+}
+
+// s3Invalidator shares invalidations by marker objects in the bucket.
+// Markers should be expired by lifecycle rule of the bucket.
+type s3Invalidator struct {
+	svc    s3iface.S3API
+	bucket string
+
+	lock        sync.Mutex
+	subscribers []func(inv invalidation)
+	seen        map[string]time.Time // Marker ID -> time, in the window
+	since       time.Time
+}
+
+func (si *s3Invalidator) publish(inv invalidation) error {
+	random, err := randomString()
+	if err != nil {
+		return err
+	}
+	id := invertedTime(time.Now()) + "-" + inv.Origin + "-" + random[:8]
+	_, err = si.svc.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(si.bucket),
+		Key:    aws.String(invalidationPrefix + id + "/" + inv.Cache + "/" + inv.Key),
+	})
+	return err
+}
+
+func (si *s3Invalidator) subscribe(f func(inv invalidation)) {
+	si.lock.Lock()
+	defer si.lock.Unlock()
+	si.subscribers = append(si.subscribers, f)
+}
+
+// parseMarker returns ID, time and invalidation of the marker key.
+func parseMarker(key string) (string, time.Time, invalidation, error) {
+	parts := strings.SplitN(strings.TrimPrefix(key, invalidationPrefix), "/", 3)
+	if len(parts) != 3 {
+		return "", time.Time{}, invalidation{}, errors.New("invalid marker: " + key)
+	}
+	id := strings.Split(parts[0], "-")
+	if len(id) != 3 {
+		return "", time.Time{}, invalidation{}, errors.New("invalid marker: " + key)
+	}
+	inverted, err := strconv.ParseInt(id[0], 10, 64)
+	if err != nil {
+		return "", time.Time{}, invalidation{}, errors.New("invalid marker: " + key)
+	}
+	inv := invalidation{Origin: id[1], Cache: parts[1], Key: parts[2]}
+	return parts[0], time.Unix(0, math.MaxInt64-inverted), inv, nil
+}
+
+// poll applies markers since the last poll, from the newest.
+func (si *s3Invalidator) poll() error {
+	si.lock.Lock()
+	defer si.lock.Unlock()
+
+	now := time.Now()
+	after := si.since.Add(-invalidationWindow)
+	params := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(si.bucket),
+		MaxKeys: aws.Int64(1000),
+		Prefix:  aws.String(invalidationPrefix),
+	}
+	var invs []invalidation
+loop:
+	for {
+		resp, err := si.svc.ListObjectsV2(params)
+		if err != nil {
+			return err
+		}
+		for _, c := range resp.Contents {
+			id, t, inv, err := parseMarker(*c.Key)
+			if err != nil {
+				continue
+			}
+			if t.Before(after) {
+				break loop
+			}
+			if _, ok := si.seen[id]; ok {
+				continue
+			}
+			si.seen[id] = t
+			invs = append(invs, inv)
+		}
+		if resp.IsTruncated == nil || !*resp.IsTruncated {
+			break
+		}
+		params.ContinuationToken = resp.NextContinuationToken
+	}
+
+	for id, t := range si.seen {
+		if t.Before(after) {
+			delete(si.seen, id)
+		}
+	}
+	si.since = now
+
+	for _, inv := range invs {
+		for _, f := range si.subscribers {
+			f(inv)
+		}
+	}
+	return nil
+}
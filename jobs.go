@@ -0,0 +1,321 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/labstack/echo"
+)
+
+// Background jobs run periodically while the server is running.
+// On shutdown, they are stopped after the running ones finish.
+//   session-sweep       Deletes sessions older than jobs.sessionMaxAge.
+//   index-rebuild       Rebuilds indexes of pages, which may miss failed updates.
+//   webhook-retry       Retries failed webhook deliveries.
+//   notify-digest       Sends digests of notifications.
+//   cache-invalidation  Polls invalidations of other instances, for CACHE_INVALIDATION=s3.
+//   diagram-render      Renders diagrams of saved pages.
+
+const (
+	sessionSweepInterval  = time.Hour
+	webhookRetryInterval  = time.Second
+	diagramRenderInterval = time.Second
+)
+
+type job struct {
+	name     string
+	interval time.Duration
+	run      func() error
+}
+
+type jobStatus struct {
+	Name     string        `json:"name"`
+	Interval time.Duration `json:"interval"`
+	Runs     int           `json:"runs"`
+	Failures int           `json:"failures"`
+	LastRun  time.Time     `json:"lastRun"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+type jobRunner struct {
+	jobs []*job
+	stop chan struct{}
+	wg   sync.WaitGroup
+
+	lock   sync.Mutex
+	status map[string]*jobStatus
+}
+
+func newJobRunner() *jobRunner {
+	return &jobRunner{
+		stop:   make(chan struct{}),
+		status: make(map[string]*jobStatus),
+	}
+}
+
+// add registers the job, it should be called before start.
+func (r *jobRunner) add(name string, interval time.Duration, run func() error) {
+	r.jobs = append(r.jobs, &job{name: name, interval: interval, run: run})
+	r.status[name] = &jobStatus{Name: name, Interval: interval}
+}
+
+func (r *jobRunner) start() {
+	for _, j := range r.jobs {
+		r.wg.Add(1)
+		go r.loop(j)
+	}
+}
+
+// shutdown stops jobs, and waits for the running ones.
+func (r *jobRunner) shutdown() {
+	close(r.stop)
+	r.wg.Wait()
+}
+
+func (r *jobRunner) loop(j *job) {
+	defer r.wg.Done()
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			r.runJob(j)
+		}
+	}
+}
+
+func (r *jobRunner) runJob(j *job) {
+	start := time.Now()
+	err := j.run()
+	duration := time.Since(start)
+
+	result := "ok"
+	r.lock.Lock()
+	s := r.status[j.name]
+	s.Runs++
+	s.LastRun = start
+	s.Duration = duration
+	s.Error = ""
+	if err != nil {
+		result = "error"
+		s.Failures++
+		s.Error = err.Error()
+	}
+	r.lock.Unlock()
+
+	metrics.jobRuns.add(label("job", j.name, "result", result), 1)
+	entry := log.WithFields(log.Fields{"job": j.name, "duration_ms": float64(duration) / float64(time.Millisecond)})
+	if err != nil {
+		entry.WithField("error", err.Error()).Error("job failed")
+	} else {
+		entry.Debug("job done")
+	}
+}
+
+// snapshot returns status of jobs, in the order of add.
+func (r *jobRunner) snapshot() []jobStatus {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var status []jobStatus
+	for _, j := range r.jobs {
+		status = append(status, *r.status[j.name])
+	}
+	return status
+}
+
+// startJobs starts background jobs of the wiki.
+func (w *Wikidata) startJobs() {
+	w.loadRetries()
+	w.jobs = newJobRunner()
+	w.jobs.add("session-sweep", sessionSweepInterval, func() error {
+		return w.sweepSessions(w.config.Jobs.SessionMaxAge)
+	})
+	w.jobs.add("index-rebuild", w.config.Jobs.IndexRebuildInterval, w.rebuildIndexes)
+	w.jobs.add("webhook-retry", webhookRetryInterval, w.retryWebhooks)
+	w.jobs.add("notify-digest", w.config.Notify.Interval, func() error {
+		w.sendDigests()
+		return nil
+	})
+	if si, ok := w.invalidator.(*s3Invalidator); ok {
+		w.jobs.add("cache-invalidation", w.config.Cache.InvalidationInterval, si.poll)
+	}
+	w.jobs.add("diagram-render", diagramRenderInterval, w.renderQueuedDiagrams)
+	w.jobs.start()
+}
+
+// shutdown stops background work, and syncs all stacks to S3.
+// It should be called after the server stops handling requests.
+func (w *Wikidata) shutdown() {
+	if w.jobs != nil {
+		w.jobs.shutdown()
+	}
+	w.deliveries.Wait()
+	w.webhookLock.Lock()
+	if n := len(w.retries); n > 0 {
+		log.WithField("deliveries", n).Info("pending webhook retries are kept for the next start")
+	}
+	w.webhookLock.Unlock()
+
+	for t, stack := range w.cacheStack {
+		err := stack.Sync()
+		if err != nil {
+			log.WithFields(log.Fields{"cache": cacheName(t), "error": err.Error()}).Error("sync failed")
+		}
+		stack.Stop()
+	}
+	err := w.bareStack.Sync()
+	if err != nil {
+		log.WithField("error", err.Error()).Error("sync failed")
+	}
+	w.bareStack.Stop()
+}
+
+// sweepSessions deletes sessions which are not updated for maxAge.
+func (w *Wikidata) sweepSessions(maxAge time.Duration) error {
+	// Sessions of metrics are pruned on the way.
+	metrics.sessionsLock.Lock()
+	metrics.pruneSessions()
+	metrics.sessionsLock.Unlock()
+
+	params := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(w.bucket),
+		MaxKeys: aws.Int64(1000),
+		Prefix:  aws.String("session/"),
+	}
+	deadline := time.Now().Add(-maxAge)
+	swept := 0
+	for {
+		resp, err := w.svc.ListObjectsV2(params)
+		if err != nil {
+			return err
+		}
+		for _, c := range resp.Contents {
+			if c.LastModified == nil || c.LastModified.After(deadline) {
+				continue
+			}
+			err = w.deleteBare(&sessionData{ID: strings.TrimPrefix(*c.Key, *params.Prefix)})
+			if err != nil {
+				return err
+			}
+			swept++
+		}
+		if resp.IsTruncated == nil || !*resp.IsTruncated {
+			break
+		}
+		params.ContinuationToken = resp.NextContinuationToken
+	}
+	if swept > 0 {
+		log.WithField("swept", swept).Info("sessions swept")
+	}
+	return nil
+}
+
+// indexUpdated records the update of indexes while rebuilding them.
+// It should be called with indexLock.
+func (w *Wikidata) indexUpdated(titleHash string) {
+	if w.rebuilt != nil {
+		w.rebuilt[titleHash] = true
+	}
+}
+
+// rebuildIndexes scans all pages, and replaces indexes of pages.
+// Pages are scanned without indexLock, and pages updated during the scan
+// are taken from the current indexes, so that the updates are not lost.
+func (w *Wikidata) rebuildIndexes() error {
+	w.indexLock.Lock()
+	w.rebuilt = make(map[string]bool)
+	w.indexLock.Unlock()
+	defer func() {
+		w.indexLock.Lock()
+		w.rebuilt = nil
+		w.indexLock.Unlock()
+	}()
+
+	titles := &titleIndexData{Titles: make(map[string]string)}
+	tags := &tagIndexData{Pages: make(reverseIndex)}
+	includes := &includeIndexData{Includers: make(reverseIndex)}
+	meta := &metaIndexData{Pages: make(map[string]*frontMatter)}
+	err := w.forEachPage(func(markdown *pageData) {
+		titles.Titles[markdown.titleHash] = markdown.title
+		tags.Pages.set(markdown.titleHash, parseTags(markdown.body))
+		includes.Includers.set(markdown.titleHash, w.includedHashes(markdown.body))
+		m, rest, err := parseFrontMatter(markdown.body)
+		if err == nil && rest != markdown.body {
+			meta.Pages[markdown.titleHash] = m
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	w.indexLock.Lock()
+	defer w.indexLock.Unlock()
+	err = w.mergeIndexes(titles, tags, includes, meta)
+	if err != nil {
+		return err
+	}
+	for _, index := range []s3Bare{titles, tags, includes, meta} {
+		err = w.saveBare(index)
+		if err != nil {
+			return err
+		}
+	}
+
+	w.pagesLock.Lock()
+	w.pages = nil
+	w.pagesLock.Unlock()
+	return nil
+}
+
+// mergeIndexes copies the pages updated during the rebuild from the current indexes.
+func (w *Wikidata) mergeIndexes(titles *titleIndexData, tags *tagIndexData, includes *includeIndexData, meta *metaIndexData) error {
+	if len(w.rebuilt) == 0 {
+		return nil
+	}
+	curTitles, err := w.loadTitleIndex()
+	if err != nil {
+		return err
+	}
+	curTags, err := w.loadTagIndex()
+	if err != nil {
+		return err
+	}
+	curIncludes, err := w.loadIncludeIndex()
+	if err != nil {
+		return err
+	}
+	curMeta, err := w.loadMetaIndex()
+	if err != nil {
+		return err
+	}
+	for titleHash := range w.rebuilt {
+		if title, ok := curTitles.Titles[titleHash]; ok {
+			titles.Titles[titleHash] = title
+		} else {
+			delete(titles.Titles, titleHash)
+		}
+		tags.Pages.set(titleHash, curTags.Pages.keys(titleHash))
+		includes.Includers.set(titleHash, curIncludes.Includers.keys(titleHash))
+		if m, ok := curMeta.Pages[titleHash]; ok {
+			meta.Pages[titleHash] = m
+		} else {
+			delete(meta.Pages, titleHash)
+		}
+	}
+	return nil
+}
+
+func (h *handler) jobsHandler(c echo.Context) (err error) {
+	if h.db.jobs == nil {
+		return c.JSON(http.StatusOK, []jobStatus{})
+	}
+	return c.JSON(http.StatusOK, h.db.jobs.snapshot())
+}
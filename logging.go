@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+)
+
+// Logs are JSON by default (LOG_FORMAT=text for terminals), at LOG_LEVEL.
+// Every request has X-Request-ID, which is logged with the access log and
+// the logs of handlers by logger(c).
+
+const requestIDHeader = "X-Request-ID"
+
+// redactedFields are never logged, even if a handler adds them by mistake.
+// Keys are matched exactly in lower case, so that counts like "swept" are kept.
+var redactedFields = map[string]bool{
+	"password": true, "secret": true, "token": true, "session": true, "sessionid": true, "session_id": true,
+	"challenge": true, "response": true, "answer": true, "cookie": true, "authorization": true,
+}
+
+type redactHook struct{}
+
+func (redactHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (redactHook) Fire(entry *log.Entry) error {
+	for key := range entry.Data {
+		if redactedFields[strings.ToLower(key)] {
+			entry.Data[key] = "[REDACTED]"
+		}
+	}
+	return nil
+}
+
+// setupLogging configures logrus by LOG_FORMAT and LOG_LEVEL.
+// debug lowers the level to debug.
+func setupLogging(format, level string, debug bool) error {
+	switch format {
+	case "", "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	case "text":
+		log.SetFormatter(&log.TextFormatter{})
+	default:
+		return errors.New("unknown log format: " + format)
+	}
+
+	lv := log.InfoLevel
+	if level != "" {
+		var err error
+		lv, err = log.ParseLevel(level)
+		if err != nil {
+			return err
+		}
+	}
+	if debug {
+		lv = log.DebugLevel
+	}
+	log.SetLevel(lv)
+	log.AddHook(redactHook{})
+	return nil
+}
+
+// validRequestID accepts IDs from proxies, which are safe to log.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDMiddleware sets X-Request-ID, from the request if it's given by proxy.
+func requestIDMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (err error) {
+			id := c.Request().Header.Get(requestIDHeader)
+			if !validRequestID(id) {
+				random, err := randomString()
+				if err != nil {
+					return err
+				}
+				id = random[:16]
+			}
+			c.Set("requestID", id)
+			c.Response().Header().Set(requestIDHeader, id)
+			return next(c)
+		}
+	}
+}
+
+// logger returns the logger with the request ID.
+func logger(c echo.Context) *log.Entry {
+	id, _ := c.Get("requestID").(string)
+	return log.WithField("request_id", id)
+}
+
+// accessLogMiddleware logs every request after it's handled.
+func accessLogMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (err error) {
+			start := time.Now()
+			err = next(c)
+			if err != nil {
+				// Write the response here, to log its status.
+				c.Error(err)
+			}
+			req := c.Request()
+			logger(c).WithFields(log.Fields{
+				"method":     req.Method,
+				"uri":        req.URL.Path,
+				"route":      c.Path(),
+				"status":     c.Response().Status,
+				"latency_ms": float64(time.Since(start)) / float64(time.Millisecond),
+				"remote_ip":  c.RealIP(),
+				"bytes_out":  c.Response().Size,
+			}).Info("request")
+			return nil
+		}
+	}
+}
+
+// errorHandler logs the error of handlers with the request ID.
+func errorHandler(e *echo.Echo) echo.HTTPErrorHandler {
+	return func(err error, c echo.Context) {
+		if he, ok := err.(*echo.HTTPError); !ok || he.Code >= http.StatusInternalServerError {
+			logger(c).WithField("error", err.Error()).Error("request failed")
+		}
+		e.DefaultHTTPErrorHandler(err, c)
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Math in $...$ (inline) and $$...$$ (display) is converted from TeX to MathML.
+// Only a common subset of TeX is supported, unknown commands are shown as text.
+
+var mathSymbols = map[string]string{
+	// Greek letters
+	"alpha": "α", "beta": "β", "gamma": "γ", "delta": "δ", "epsilon": "ϵ", "varepsilon": "ε",
+	"zeta": "ζ", "eta": "η", "theta": "θ", "iota": "ι", "kappa": "κ", "lambda": "λ",
+	"mu": "μ", "nu": "ν", "xi": "ξ", "pi": "π", "rho": "ρ", "sigma": "σ", "tau": "τ",
+	"upsilon": "υ", "phi": "ϕ", "varphi": "φ", "chi": "χ", "psi": "ψ", "omega": "ω",
+	"Gamma": "Γ", "Delta": "Δ", "Theta": "Θ", "Lambda": "Λ", "Xi": "Ξ", "Pi": "Π",
+	"Sigma": "Σ", "Upsilon": "Υ", "Phi": "Φ", "Psi": "Ψ", "Omega": "Ω",
+	"infty": "∞", "partial": "∂", "nabla": "∇", "ell": "ℓ", "hbar": "ℏ",
+}
+
+var mathOperators = map[string]string{
+	"cdot": "⋅", "times": "×", "div": "÷", "pm": "±", "mp": "∓", "ast": "∗", "circ": "∘",
+	"leq": "≤", "le": "≤", "geq": "≥", "ge": "≥", "neq": "≠", "ne": "≠", "lt": "<", "gt": ">",
+	"approx": "≈", "equiv": "≡", "sim": "∼", "propto": "∝",
+	"sum": "∑", "prod": "∏", "int": "∫", "oint": "∮",
+	"to": "→", "rightarrow": "→", "leftarrow": "←", "Rightarrow": "⇒", "Leftarrow": "⇐",
+	"leftrightarrow": "↔", "Leftrightarrow": "⇔", "mapsto": "↦",
+	"in": "∈", "notin": "∉", "subset": "⊂", "subseteq": "⊆", "supset": "⊃", "supseteq": "⊇",
+	"cup": "∪", "cap": "∩", "emptyset": "∅", "forall": "∀", "exists": "∃", "neg": "¬",
+	"land": "∧", "lor": "∨", "ldots": "…", "cdots": "⋯", "vdots": "⋮",
+	"langle": "⟨", "rangle": "⟩", "lfloor": "⌊", "rfloor": "⌋", "lceil": "⌈", "rceil": "⌉",
+	"{": "{", "}": "}", "|": "‖", "$": "$", "%": "%", "&": "&", "#": "#", "_": "_",
+}
+
+var mathFunctions = map[string]bool{
+	"sin": true, "cos": true, "tan": true, "sec": true, "csc": true, "cot": true,
+	"arcsin": true, "arccos": true, "arctan": true, "sinh": true, "cosh": true, "tanh": true,
+	"log": true, "ln": true, "lg": true, "exp": true, "lim": true, "max": true, "min": true,
+	"sup": true, "inf": true, "det": true, "gcd": true, "deg": true, "dim": true, "arg": true,
+}
+
+var mathSpaces = map[string]string{
+	",": "0.167em", ":": "0.222em", ";": "0.278em", "quad": "1em", "qquad": "2em", " ": "0.333em",
+}
+
+// Limits of a formula, so that a page can't make rendering slow.
+const (
+	mathMaxDepth  = 64   // Nesting of groups, commands and scripts
+	mathMaxLength = 4096 // Runes
+	mathMaxAtoms  = 2048
+)
+
+type texParser struct {
+	s     []rune
+	pos   int
+	depth int
+	atoms int
+}
+
+// texToMathML converts TeX into MathML.
+func texToMathML(tex string, display bool) string {
+	attr := ""
+	if display {
+		attr = ` display="block"`
+	}
+	math := func(body string) string {
+		return `<math xmlns="http://www.w3.org/1998/Math/MathML"` + attr + `><mrow>` + body + `</mrow></math>`
+	}
+
+	p := &texParser{s: []rune(tex)}
+	if len(p.s) > mathMaxLength {
+		return math("<merror><mtext>too long</mtext></merror>")
+	}
+	var body bytes.Buffer
+	for p.pos < len(p.s) {
+		body.WriteString(p.parseExpr(0))
+		if p.pos < len(p.s) {
+			// Unbalanced closing brace
+			body.WriteString("<mo>" + html.EscapeString(string(p.s[p.pos])) + "</mo>")
+			p.pos++
+		}
+	}
+	return math(body.String())
+}
+
+// enter counts nesting and atoms, and returns the error if it's over the limits.
+// leave should be called after that, even if it's error.
+func (p *texParser) enter() string {
+	p.depth++
+	p.atoms++
+	switch {
+	case p.depth > mathMaxDepth:
+		p.pos = len(p.s)
+		return "<merror><mtext>too deep</mtext></merror>"
+	case p.atoms > mathMaxAtoms:
+		p.pos = len(p.s)
+		return "<merror><mtext>too large</mtext></merror>"
+	}
+	return ""
+}
+
+func (p *texParser) leave() {
+	p.depth--
+}
+
+func (p *texParser) skipSpace() {
+	for p.pos < len(p.s) && unicode.IsSpace(p.s[p.pos]) {
+		p.pos++
+	}
+}
+
+// parseExpr parses until stop rune, which is not consumed.
+func (p *texParser) parseExpr(stop rune) string {
+	var out bytes.Buffer
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.s) || p.s[p.pos] == stop || p.s[p.pos] == '}' {
+			return out.String()
+		}
+		out.WriteString(p.parseScripted(stop))
+	}
+}
+
+// parseScripted parses an atom with subscript and superscript.
+func (p *texParser) parseScripted(stop rune) string {
+	base := p.parseAtom(stop)
+	var sub, sup string
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.s) {
+			break
+		}
+		c := p.s[p.pos]
+		if c == '_' && sub == "" {
+			p.pos++
+			sub = p.parseArg()
+		} else if c == '^' && sup == "" {
+			p.pos++
+			sup = p.parseArg()
+		} else if c == '\'' && sup == "" {
+			p.pos++
+			sup = "<mo>′</mo>"
+		} else {
+			break
+		}
+	}
+	if base == "" {
+		base = "<mrow></mrow>"
+	}
+	switch {
+	case sub != "" && sup != "":
+		return "<msubsup>" + base + sub + sup + "</msubsup>"
+	case sub != "":
+		return "<msub>" + base + sub + "</msub>"
+	case sup != "":
+		return "<msup>" + base + sup + "</msup>"
+	}
+	return base
+}
+
+// parseArg parses {group} or a single atom, as an argument of command or script.
+func (p *texParser) parseArg() string {
+	defer p.leave()
+	if e := p.enter(); e != "" {
+		return e
+	}
+	p.skipSpace()
+	if p.pos < len(p.s) && p.s[p.pos] == '{' {
+		return p.parseGroup()
+	}
+	atom := p.parseAtom(0)
+	if atom == "" {
+		return "<mrow></mrow>"
+	}
+	return atom
+}
+
+func (p *texParser) parseGroup() string {
+	p.pos++ // {
+	body := p.parseExpr('}')
+	if p.pos < len(p.s) && p.s[p.pos] == '}' {
+		p.pos++
+	}
+	return "<mrow>" + body + "</mrow>"
+}
+
+// readRaw reads {text} as-is.
+func (p *texParser) readRaw() string {
+	p.skipSpace()
+	if p.pos >= len(p.s) || p.s[p.pos] != '{' {
+		return ""
+	}
+	start := p.pos + 1
+	depth := 0
+	for ; p.pos < len(p.s); p.pos++ {
+		switch p.s[p.pos] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				p.pos++
+				return string(p.s[start : p.pos-1])
+			}
+		}
+	}
+	return string(p.s[start:])
+}
+
+func (p *texParser) parseAtom(stop rune) string {
+	defer p.leave()
+	if e := p.enter(); e != "" {
+		return e
+	}
+	p.skipSpace()
+	if p.pos >= len(p.s) {
+		return ""
+	}
+	c := p.s[p.pos]
+	switch {
+	case c == stop || c == '}':
+		return ""
+	case c == '{':
+		return p.parseGroup()
+	case c == '\\':
+		return p.parseCommand()
+	case unicode.IsDigit(c) || (c == '.' && p.pos+1 < len(p.s) && unicode.IsDigit(p.s[p.pos+1])):
+		start := p.pos
+		for p.pos < len(p.s) && (unicode.IsDigit(p.s[p.pos]) || p.s[p.pos] == '.') {
+			p.pos++
+		}
+		return "<mn>" + string(p.s[start:p.pos]) + "</mn>"
+	case unicode.IsLetter(c):
+		p.pos++
+		return "<mi>" + html.EscapeString(string(c)) + "</mi>"
+	}
+	p.pos++
+	return "<mo>" + html.EscapeString(string(c)) + "</mo>"
+}
+
+func (p *texParser) parseCommand() string {
+	p.pos++ // backslash
+	if p.pos >= len(p.s) {
+		return "<mo>\\</mo>"
+	}
+	start := p.pos
+	if unicode.IsLetter(p.s[p.pos]) {
+		for p.pos < len(p.s) && unicode.IsLetter(p.s[p.pos]) {
+			p.pos++
+		}
+	} else {
+		p.pos++
+	}
+	name := string(p.s[start:p.pos])
+
+	if s, ok := mathSymbols[name]; ok {
+		return "<mi>" + s + "</mi>"
+	}
+	if s, ok := mathOperators[name]; ok {
+		return "<mo>" + html.EscapeString(s) + "</mo>"
+	}
+	if mathFunctions[name] {
+		return "<mi>" + name + "</mi>"
+	}
+	if width, ok := mathSpaces[name]; ok {
+		return `<mspace width="` + width + `"></mspace>`
+	}
+
+	switch name {
+	case "frac":
+		return "<mfrac>" + p.parseArg() + p.parseArg() + "</mfrac>"
+	case "sqrt":
+		p.skipSpace()
+		if p.pos < len(p.s) && p.s[p.pos] == '[' {
+			p.pos++
+			index := p.parseExpr(']')
+			if p.pos < len(p.s) && p.s[p.pos] == ']' {
+				p.pos++
+			}
+			return "<mroot>" + p.parseArg() + "<mrow>" + index + "</mrow></mroot>"
+		}
+		return "<msqrt>" + p.parseArg() + "</msqrt>"
+	case "text", "mbox":
+		return "<mtext>" + html.EscapeString(p.readRaw()) + "</mtext>"
+	case "mathrm", "mathbf", "mathit", "mathbb", "mathcal":
+		variant := map[string]string{
+			"mathrm": "normal", "mathbf": "bold", "mathit": "italic",
+			"mathbb": "double-struck", "mathcal": "script",
+		}[name]
+		return `<mstyle mathvariant="` + variant + `">` + p.parseArg() + "</mstyle>"
+	case "left", "right", "big", "Big", "bigl", "bigr":
+		// Delimiters are stretched by MathML renderer.
+		p.skipSpace()
+		if p.pos < len(p.s) && p.s[p.pos] == '.' {
+			p.pos++
+			return ""
+		}
+		return p.parseAtom(0)
+	}
+	return "<mtext>\\" + html.EscapeString(name) + "</mtext>"
+}
+
+const mathMarker = "BUCKETWIKIMATH"
+
+var (
+	mathMarkerRegexp      = regexp.MustCompile(mathMarker + `([0-9]+)MARKER`)
+	mathBlockMarkerRegexp = regexp.MustCompile(`<p>` + mathMarker + `([0-9]+)MARKER</p>`)
+	inlineMathRegexp      = regexp.MustCompile(`\$\$([^$]+?)\$\$|\$([^\s$](?:[^$]*?[^\s$\\])?)\$([^0-9]|$)`)
+)
+
+// extractMath replaces math outside of code with markers, and returns MathML of them.
+// Fenced, indented and inline code are skipped.
+func extractMath(body string) (string, []string) {
+	var maths []string
+	marker := func(tex string, display bool) string {
+		maths = append(maths, texToMathML(tex, display))
+		return mathMarker + strconv.Itoa(len(maths)-1) + "MARKER"
+	}
+
+	var out bytes.Buffer
+	lines := strings.SplitAfter(body, "\n")
+	fence := ""
+	var block []string
+	inBlock := false
+	prevBlank, indented := true, false
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		// Indented code starts after a blank line, and continues over blank lines.
+		code := fence == "" && !inBlock && (prevBlank || indented) && trimmed != "" &&
+			(strings.HasPrefix(line, "    ") || strings.HasPrefix(line, "\t"))
+		indented = code || (indented && trimmed == "")
+		prevBlank = trimmed == ""
+		switch {
+		case code:
+			out.WriteString(line)
+		case fence != "":
+			if strings.HasPrefix(trimmed, fence) {
+				fence = ""
+			}
+			out.WriteString(line)
+		case inBlock:
+			if trimmed == "$$" {
+				out.WriteString(marker(strings.Join(block, ""), true) + "\n")
+				inBlock = false
+				block = nil
+				continue
+			}
+			block = append(block, line)
+		case strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~"):
+			fence = trimmed[:3]
+			out.WriteString(line)
+		case trimmed == "$$":
+			inBlock = true
+		default:
+			// Skip `inline code`
+			parts := strings.Split(line, "`")
+			for i, part := range parts {
+				if i > 0 {
+					out.WriteString("`")
+				}
+				if i%2 == 1 {
+					out.WriteString(part)
+					continue
+				}
+				out.WriteString(inlineMathRegexp.ReplaceAllStringFunc(part, func(a string) string {
+					m := inlineMathRegexp.FindStringSubmatch(a)
+					if m[1] != "" {
+						return marker(m[1], true)
+					}
+					return marker(m[2], false) + m[3]
+				}))
+			}
+		}
+	}
+	if inBlock {
+		// Not closed
+		out.WriteString("$$\n" + strings.Join(block, ""))
+	}
+	return out.String(), maths
+}
+
+// replaceMath replaces markers with MathML.
+func replaceMath(html []byte, maths []string) []byte {
+	mathml := func(a []byte, re *regexp.Regexp) []byte {
+		i, err := strconv.Atoi(string(re.FindSubmatch(a)[1]))
+		if err != nil || i >= len(maths) {
+			return a
+		}
+		return []byte(maths[i])
+	}
+	html = mathBlockMarkerRegexp.ReplaceAllFunc(html, func(a []byte) []byte {
+		return mathml(a, mathBlockMarkerRegexp)
+	})
+	return mathMarkerRegexp.ReplaceAllFunc(html, func(a []byte) []byte {
+		return mathml(a, mathMarkerRegexp)
+	})
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/labstack/echo"
+)
+
+// /metrics exposes metrics in Prometheus text format.
+// If metricsToken (METRICS_TOKEN) is set, it requires "Authorization: Bearer <token>".
+
+// Sessions seen in this window are active.
+const activeSessionWindow = 30 * time.Minute
+
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// counterVec is counters by label values.
+type counterVec struct {
+	lock   sync.Mutex
+	values map[string]float64 // Formatted labels -> value
+}
+
+func (cv *counterVec) add(labels string, v float64) {
+	cv.lock.Lock()
+	defer cv.lock.Unlock()
+	if cv.values == nil {
+		cv.values = make(map[string]float64)
+	}
+	cv.values[labels] += v
+}
+
+func (cv *counterVec) write(buf *bytes.Buffer, name, help string) {
+	cv.lock.Lock()
+	defer cv.lock.Unlock()
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	for _, labels := range sortedKeys(cv.values) {
+		if labels == "" {
+			fmt.Fprintf(buf, "%s %s\n", name, formatFloat(cv.values[labels]))
+			continue
+		}
+		fmt.Fprintf(buf, "%s{%s} %s\n", name, labels, formatFloat(cv.values[labels]))
+	}
+}
+
+type histogram struct {
+	counts []uint64 // by latencyBuckets, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// histogramVec is histograms of latency by label values.
+type histogramVec struct {
+	lock   sync.Mutex
+	values map[string]*histogram
+}
+
+func (hv *histogramVec) observe(labels string, d time.Duration) {
+	hv.lock.Lock()
+	defer hv.lock.Unlock()
+	if hv.values == nil {
+		hv.values = make(map[string]*histogram)
+	}
+	h, ok := hv.values[labels]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		hv.values[labels] = h
+	}
+	v := d.Seconds()
+	for i, le := range latencyBuckets {
+		if v <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (hv *histogramVec) write(buf *bytes.Buffer, name, help string) {
+	hv.lock.Lock()
+	defer hv.lock.Unlock()
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	keys := make([]string, 0, len(hv.values))
+	for k := range hv.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, labels := range keys {
+		h := hv.values[labels]
+		var cumulative uint64
+		for i, le := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(buf, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, formatFloat(le), cumulative)
+		}
+		fmt.Fprintf(buf, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+		fmt.Fprintf(buf, "%s_sum{%s} %s\n", name, labels, formatFloat(h.sum))
+		fmt.Fprintf(buf, "%s_count{%s} %d\n", name, labels, h.count)
+	}
+}
+
+func writeGauge(buf *bytes.Buffer, name, help string, v float64) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(v))
+}
+
+// label formats label pairs, like label("method", "GET") for method="GET".
+func label(pairs ...string) string {
+	var labels []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		labels = append(labels, pairs[i]+"="+strconv.Quote(pairs[i+1]))
+	}
+	return strings.Join(labels, ",")
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type metricsRegistry struct {
+	requests        counterVec
+	requestDuration histogramVec
+	storageErrors   counterVec
+	storageDuration histogramVec
+	uploadBytes     counterVec
+	jobRuns         counterVec
+
+	sessionsLock sync.Mutex
+	sessions     map[string]time.Time // Session ID -> last seen
+	pruneAt      int                  // Size of sessions to prune on insert
+}
+
+const minSessionsPrune = 1024
+
+var metrics = &metricsRegistry{sessions: make(map[string]time.Time), pruneAt: minSessionsPrune}
+
+// touchSession records the session is active. Inactive sessions are pruned
+// when the map doubles, so that it's bounded by sessions in the window.
+func (m *metricsRegistry) touchSession(id string) {
+	m.sessionsLock.Lock()
+	defer m.sessionsLock.Unlock()
+	m.sessions[id] = time.Now()
+	if len(m.sessions) >= m.pruneAt {
+		m.pruneSessions()
+		m.pruneAt = 2 * len(m.sessions)
+		if m.pruneAt < minSessionsPrune {
+			m.pruneAt = minSessionsPrune
+		}
+	}
+}
+
+// pruneSessions deletes inactive sessions, it should be called with sessionsLock.
+func (m *metricsRegistry) pruneSessions() {
+	for id, t := range m.sessions {
+		if time.Since(t) > activeSessionWindow {
+			delete(m.sessions, id)
+		}
+	}
+}
+
+func (m *metricsRegistry) activeSessions() int {
+	m.sessionsLock.Lock()
+	defer m.sessionsLock.Unlock()
+	m.pruneSessions()
+	return len(m.sessions)
+}
+
+// observeStorage records the S3 operation started at start.
+func (m *metricsRegistry) observeStorage(op string, start time.Time, err error) {
+	m.storageDuration.observe(label("operation", op), time.Since(start))
+	if err != nil && !isNotFound(err) {
+		m.storageErrors.add(label("operation", op), 1)
+	}
+}
+
+// metricsMiddleware records requests by route pattern, such as /page/:titleHash.
+func metricsMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (err error) {
+			start := time.Now()
+			err = next(c)
+			status := c.Response().Status
+			if he, ok := err.(*echo.HTTPError); ok {
+				status = he.Code
+			} else if err != nil {
+				status = http.StatusInternalServerError
+			}
+			method := c.Request().Method
+			route := c.Path()
+			metrics.requests.add(label("method", method, "route", route, "status", strconv.Itoa(status)), 1)
+			metrics.requestDuration.observe(label("method", method, "route", route), time.Since(start))
+			return err
+		}
+	}
+}
+
+// metricsHandler requires METRICS_TOKEN for scrapers, or the session of admins if it's not set.
+func (h *handler) metricsHandler(c echo.Context) (err error) {
+	token := h.db.config.MetricsToken
+	if token != "" {
+		auth := c.Request().Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+token)) != 1 {
+			return echo.NewHTTPError(http.StatusUnauthorized)
+		}
+	} else {
+		sess, err := h.getSession(c)
+		if err != nil || !sess.Login || !h.db.config.isAdmin(sess.User) {
+			return echo.NewHTTPError(http.StatusForbidden, "admin only, or set METRICS_TOKEN")
+		}
+	}
+
+	var buf bytes.Buffer
+	metrics.requests.write(&buf, "bucketwiki_http_requests_total", "HTTP requests by route and status.")
+	metrics.requestDuration.write(&buf, "bucketwiki_http_request_duration_seconds", "HTTP request latency by route.")
+	metrics.storageDuration.write(&buf, "bucketwiki_storage_operation_duration_seconds", "S3 operation latency.")
+	metrics.storageErrors.write(&buf, "bucketwiki_storage_errors_total", "S3 operation errors, except not found.")
+	metrics.uploadBytes.write(&buf, "bucketwiki_upload_bytes_total", "Bytes of uploaded files.")
+	metrics.jobRuns.write(&buf, "bucketwiki_job_runs_total", "Runs of background jobs by result.")
+
+	var hits, misses, evictions counterVec
+	for _, stats := range h.db.cacheStatus() {
+		l := label("cache", stats.Name)
+		hits.add(l, float64(stats.Hits+stats.Negative))
+		misses.add(l, float64(stats.Misses))
+		evictions.add(l, float64(stats.Evictions))
+	}
+	hits.write(&buf, "bucketwiki_cache_hits_total", "Cache hits by type, including negative entries.")
+	misses.write(&buf, "bucketwiki_cache_misses_total", "Cache misses by type.")
+	evictions.write(&buf, "bucketwiki_cache_evictions_total", "Cache evictions by type.")
+
+	writeGauge(&buf, "bucketwiki_active_sessions", "Sessions seen in the last 30 minutes.", float64(metrics.activeSessions()))
+	titles, err := h.db.titles()
+	if err != nil {
+		logger(c).WithField("error", err.Error()).Error("load titles failed")
+	} else {
+		writeGauge(&buf, "bucketwiki_pages", "Number of pages.", float64(len(titles)))
+	}
+	return c.Blob(http.StatusOK, "text/plain; version=0.0.4", buf.Bytes())
+}
+
+// instrumentedS3 records metrics of S3 operations used by the wiki.
+type instrumentedS3 struct {
+	s3iface.S3API
+}
+
+func (i *instrumentedS3) GetObject(in *s3.GetObjectInput) (out *s3.GetObjectOutput, err error) {
+	defer func(start time.Time) { metrics.observeStorage("Get", start, err) }(time.Now())
+	return i.S3API.GetObject(in)
+}
+
+func (i *instrumentedS3) HeadObject(in *s3.HeadObjectInput) (out *s3.HeadObjectOutput, err error) {
+	defer func(start time.Time) { metrics.observeStorage("Head", start, err) }(time.Now())
+	return i.S3API.HeadObject(in)
+}
+
+func (i *instrumentedS3) PutObject(in *s3.PutObjectInput) (out *s3.PutObjectOutput, err error) {
+	defer func(start time.Time) { metrics.observeStorage("Put", start, err) }(time.Now())
+	return i.S3API.PutObject(in)
+}
+
+func (i *instrumentedS3) DeleteObject(in *s3.DeleteObjectInput) (out *s3.DeleteObjectOutput, err error) {
+	defer func(start time.Time) { metrics.observeStorage("Delete", start, err) }(time.Now())
+	return i.S3API.DeleteObject(in)
+}
+
+func (i *instrumentedS3) ListObjectsV2(in *s3.ListObjectsV2Input) (out *s3.ListObjectsV2Output, err error) {
+	defer func(start time.Time) { metrics.observeStorage("List", start, err) }(time.Now())
+	return i.S3API.ListObjectsV2(in)
+}
+
+func (i *instrumentedS3) ListObjectVersions(in *s3.ListObjectVersionsInput) (out *s3.ListObjectVersionsOutput, err error) {
+	defer func(start time.Time) { metrics.observeStorage("Version", start, err) }(time.Now())
+	return i.S3API.ListObjectVersions(in)
+}
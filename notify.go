@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+)
+
+// Users watch pages or namespaces. Changes by others are added to the
+// notifications of watchers, and undelivered ones are sent as a digest
+// by notifiers every NOTIFY_INTERVAL.
+// Webhooks set by users are posted only to public addresses, so that users
+// can't reach the internal network of the server, such as the EC2 metadata service.
+
+const maxNotifications = 100
+
+// notifier delivers a digest of notifications.
+// It does nothing for the watcher who doesn't configure it.
+type notifier interface {
+	name() string
+	notify(user string, to *watcher, items []*notification) error
+}
+
+// newNotifiers returns webhook notifier, and SMTP notifier if SMTP is configured.
+func newNotifiers(c *config) []notifier {
+	notifiers := []notifier{
+		&webhookNotifier{client: publicClient(10 * time.Second), base: c.URL},
+	}
+	if addr := c.Notify.SMTPAddr; addr != "" {
+		s := &smtpNotifier{
+			addr: addr,
+			from: c.Notify.SMTPFrom,
+			base: c.URL,
+		}
+		if username := c.Notify.SMTPUsername; username != "" {
+			host, _, _ := net.SplitHostPort(addr)
+			s.auth = smtp.PlainAuth("", username, c.Notify.SMTPPassword, host)
+		}
+		notifiers = append(notifiers, s)
+	}
+	return notifiers
+}
+
+func (wt *watcher) watches(change *changeData) bool {
+	if wt.Pages[change.TitleHash] {
+		return true
+	}
+	for namespace := range wt.Namespaces {
+		if change.Title == namespace || strings.HasPrefix(change.Title, namespace+titleSeparator) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *Wikidata) loadWatch() *watchData {
+	watch := &watchData{}
+	err := w.loadBare(watch)
+	if err != nil {
+		// Nobody watches yet
+		watch.Users = make(map[string]*watcher)
+	}
+	return watch
+}
+
+func (w *Wikidata) loadNotifications(user string) *notificationData {
+	n := &notificationData{User: user}
+	err := w.loadBare(n)
+	if err != nil {
+		n.Items = nil
+	}
+	return n
+}
+
+// watcher returns the settings of the user.
+func (w *Wikidata) watcher(user string) *watcher {
+	w.notifyLock.Lock()
+	defer w.notifyLock.Unlock()
+
+	wt, ok := w.loadWatch().Users[user]
+	if !ok {
+		return &watcher{}
+	}
+	return wt
+}
+
+// updateWatcher changes the settings of the user by f.
+func (w *Wikidata) updateWatcher(user string, f func(wt *watcher)) error {
+	w.notifyLock.Lock()
+	defer w.notifyLock.Unlock()
+
+	watch := w.loadWatch()
+	wt, ok := watch.Users[user]
+	if !ok {
+		wt = &watcher{}
+		watch.Users[user] = wt
+	}
+	if wt.Pages == nil {
+		wt.Pages = make(map[string]bool)
+	}
+	if wt.Namespaces == nil {
+		wt.Namespaces = make(map[string]bool)
+	}
+	f(wt)
+	return w.saveBare(watch)
+}
+
+// notify adds the change to the notifications of watchers.
+func (w *Wikidata) notify(change *changeData) {
+	w.notifyLock.Lock()
+	defer w.notifyLock.Unlock()
+
+	for user, wt := range w.loadWatch().Users {
+		if user == change.User || !wt.watches(change) {
+			continue
+		}
+		n := w.loadNotifications(user)
+		n.Items = append([]*notification{{Change: change}}, n.Items...)
+		if len(n.Items) > maxNotifications {
+			n.Items = n.Items[:maxNotifications]
+		}
+		err := w.saveBare(n)
+		if err != nil {
+			log.WithFields(log.Fields{"user": user, "error": err.Error()}).Error("notify failed")
+		}
+	}
+}
+
+// sendDigests sends notifications which are not sent by each notifier yet.
+// If a notifier fails, its items are sent again with the next digest,
+// and the other notifiers don't send them twice.
+func (w *Wikidata) sendDigests() {
+	type digest struct {
+		to    *watcher
+		items map[string][]*notification // By name of notifier
+	}
+	digests := make(map[string]*digest)
+
+	w.notifyLock.Lock()
+	for user, wt := range w.loadWatch().Users {
+		d := &digest{to: wt, items: make(map[string][]*notification)}
+		for _, item := range w.loadNotifications(user).Items {
+			if item.Delivered {
+				continue
+			}
+			for _, n := range w.notifiers {
+				if !item.Sent[n.name()] {
+					d.items[n.name()] = append(d.items[n.name()], item)
+				}
+			}
+		}
+		if len(d.items) > 0 {
+			digests[user] = d
+		}
+	}
+	w.notifyLock.Unlock()
+
+	for user, d := range digests {
+		sent := make(map[string]map[string]bool) // Name of notifier -> change IDs
+		for _, n := range w.notifiers {
+			items := d.items[n.name()]
+			if len(items) == 0 {
+				continue
+			}
+			err := n.notify(user, d.to, items)
+			if err != nil {
+				log.WithFields(log.Fields{"notifier": n.name(), "user": user, "error": err.Error()}).Error("send digest failed")
+				continue
+			}
+			sent[n.name()] = make(map[string]bool)
+			for _, item := range items {
+				sent[n.name()][item.Change.ID] = true
+			}
+		}
+		if len(sent) == 0 {
+			continue
+		}
+
+		w.notifyLock.Lock()
+		n := w.loadNotifications(user)
+		for _, item := range n.Items {
+			for name, ids := range sent {
+				if ids[item.Change.ID] {
+					if item.Sent == nil {
+						item.Sent = make(map[string]bool)
+					}
+					item.Sent[name] = true
+				}
+			}
+			delivered := true
+			for _, notifier := range w.notifiers {
+				delivered = delivered && item.Sent[notifier.name()]
+			}
+			item.Delivered = item.Delivered || delivered
+		}
+		err := w.saveBare(n)
+		w.notifyLock.Unlock()
+		if err != nil {
+			log.WithFields(log.Fields{"user": user, "error": err.Error()}).Error("save notifications failed")
+		}
+	}
+}
+
+// pageURL returns URL of the page, base is URL of the wiki.
+func pageURL(base string, change *changeData) string {
+	return base + "/page/" + change.TitleHash + "?title=" + url.QueryEscape(change.Title)
+}
+
+type smtpNotifier struct {
+	addr string
+	from string
+	auth smtp.Auth
+	base string
+}
+
+func (s *smtpNotifier) name() string {
+	return "email"
+}
+
+func (s *smtpNotifier) notify(user string, to *watcher, items []*notification) error {
+	if to.Email == "" {
+		return nil
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to.Email)
+	fmt.Fprintf(&msg, "Subject: [Bucket Wiki] %d changes of watched pages\r\n", len(items))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	for _, item := range items {
+		c := item.Change
+		fmt.Fprintf(&msg, "%s %s %s by %s\r\n", c.Time.Format("2006-01-02 15:04"), c.Title, c.Action, c.User)
+		if c.Summary != "" {
+			fmt.Fprintf(&msg, "  %s\r\n", c.Summary)
+		}
+		fmt.Fprintf(&msg, "  %s\r\n\r\n", pageURL(s.base, c))
+	}
+	return smtp.SendMail(s.addr, s.auth, s.from, []string{to.Email}, msg.Bytes())
+}
+
+// publicIP returns true if ip is a public unicast address.
+func publicIP(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !ip.IsLoopback() && !ip.IsLinkLocalUnicast()
+}
+
+// publicClient returns the client which connects only to public addresses.
+// Addresses are checked on connect, so that DNS and redirects can't bypass it.
+func publicClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				host, port, err := net.SplitHostPort(addr)
+				if err != nil {
+					return nil, err
+				}
+				ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+				if err != nil {
+					return nil, err
+				}
+				for _, ip := range ips {
+					if publicIP(ip.IP) {
+						return dialer.DialContext(ctx, network, net.JoinHostPort(ip.IP.String(), port))
+					}
+				}
+				return nil, fmt.Errorf("%s is not a public address", host)
+			},
+		},
+	}
+}
+
+type webhookNotifier struct {
+	client *http.Client
+	base   string
+}
+
+func (wh *webhookNotifier) name() string {
+	return "webhook"
+}
+
+func (wh *webhookNotifier) notify(user string, to *watcher, items []*notification) error {
+	if to.Webhook == "" {
+		return nil
+	}
+	var changes []map[string]interface{}
+	for _, item := range items {
+		changes = append(changes, map[string]interface{}{
+			"time":    item.Change.Time,
+			"title":   item.Change.Title,
+			"action":  item.Change.Action,
+			"user":    item.Change.User,
+			"summary": item.Change.Summary,
+			"url":     pageURL(wh.base, item.Change),
+		})
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"user":    user,
+		"changes": changes,
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := wh.client.Post(to.Webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returns %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (h *handler) watchHandler(c echo.Context) (err error) {
+	titleHash := c.Param("titleHash")
+	watch := c.FormValue("watch") == "true"
+	sess := c.Get("session").(*sessionData)
+
+	err = h.db.updateWatcher(sess.User, func(wt *watcher) {
+		if watch {
+			wt.Pages[titleHash] = true
+		} else {
+			delete(wt.Pages, titleHash)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusFound, "/page/"+titleHash)
+}
+
+func (h *handler) notificationsHandler(c echo.Context) (err error) {
+	sess := c.Get("session").(*sessionData)
+
+	h.db.notifyLock.Lock()
+	n := h.db.loadNotifications(sess.User)
+	h.db.notifyLock.Unlock()
+	wt := h.db.watcher(sess.User)
+
+	titles, err := h.db.titles()
+	if err != nil {
+		return err
+	}
+	var pages []*pageNode
+	for titleHash := range wt.Pages {
+		if title, ok := titles[titleHash]; ok {
+			pages = append(pages, &pageNode{Name: title, Title: title, TitleHash: titleHash, Exists: true})
+		}
+	}
+
+	return c.Render(http.StatusOK, "notifications.html", map[string]interface{}{
+		"Items":   n.Items,
+		"Watcher": wt,
+		"Pages":   pages,
+	})
+}
+
+func (h *handler) notificationSettingsHandler(c echo.Context) (err error) {
+	sess := c.Get("session").(*sessionData)
+
+	email := strings.TrimSpace(c.FormValue("email"))
+	if email != "" {
+		addr, err := mail.ParseAddress(email)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid email")
+		}
+		email = addr.Address
+	}
+	webhook := strings.TrimSpace(c.FormValue("webhook"))
+	if webhook != "" {
+		u, err := url.Parse(webhook)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.User != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid webhook URL")
+		}
+		if ip := net.ParseIP(u.Hostname()); u.Hostname() == "localhost" || (ip != nil && !publicIP(ip)) {
+			return echo.NewHTTPError(http.StatusBadRequest, "webhook URL should be a public address")
+		}
+	}
+
+	err = h.db.updateWatcher(sess.User, func(wt *watcher) {
+		wt.Email = email
+		wt.Webhook = webhook
+	})
+	if err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusFound, "/notifications")
+}
+
+func (h *handler) watchNamespaceHandler(c echo.Context) (err error) {
+	sess := c.Get("session").(*sessionData)
+	namespace := strings.Trim(c.FormValue("namespace"), titleSeparator)
+	if namespace == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "namespace is required")
+	}
+	watch := c.FormValue("watch") == "true"
+
+	err = h.db.updateWatcher(sess.User, func(wt *watcher) {
+		if watch {
+			wt.Namespaces[namespace] = true
+		} else {
+			delete(wt.Namespaces, namespace)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusFound, "/notifications")
+}
+
+func (h *handler) readNotificationsHandler(c echo.Context) (err error) {
+	sess := c.Get("session").(*sessionData)
+
+	h.db.notifyLock.Lock()
+	defer h.db.notifyLock.Unlock()
+	n := h.db.loadNotifications(sess.User)
+	for _, item := range n.Items {
+		item.Read = true
+	}
+	err = h.db.with(c).saveBare(n)
+	if err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusFound, "/notifications")
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+)
+
+// Public pages are published as a static site by publisher.
+//   index.html              List of public pages
+//   sitemap.xml             Sitemap of public pages
+//   highlight.css           Style of highlighted code
+//   page/<hash>/index.html  Public page rendered with style/public.html
+//   page/<hash>/file/*      Attachments of public page
+
+func (h *handler) publishHandler(c echo.Context) (err error) {
+	err = h.db.republish()
+	if err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusFound, "/")
+}
+
+func (w *Wikidata) publicPath(titleHash string) string {
+	return "/page/" + titleHash + "/"
+}
+
+func (w *Wikidata) publicHTMLPath(titleHash string) string {
+	return "page/" + titleHash + "/index.html"
+}
+
+func (w *Wikidata) loadPublicIndex() (*publicIndexData, error) {
+	index := &publicIndexData{}
+	err := w.loadBare(index)
+	if err != nil {
+		// First publish or broken index, scan pages to recover it.
+		log.WithField("error", err.Error()).Warn("public index not found, rebuild")
+		return w.rebuildPublicIndex()
+	}
+	return index, nil
+}
+
+func (w *Wikidata) rebuildPublicIndex() (*publicIndexData, error) {
+	index := &publicIndexData{Pages: make(map[string]*publicPage)}
+
+	err := w.forEachPage(func(markdown *pageData) {
+		if markdown.public {
+			index.Pages[markdown.titleHash] = &publicPage{
+				Title:      markdown.title,
+				TitleHash:  markdown.titleHash,
+				LastUpdate: markdown.lastUpdate,
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = w.saveBare(index)
+	if err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// republish scans all pages and builds the public site from scratch.
+func (w *Wikidata) republish() error {
+	w.publishLock.Lock()
+	defer w.publishLock.Unlock()
+
+	index, err := w.rebuildPublicIndex()
+	if err != nil {
+		return err
+	}
+	for titleHash := range index.Pages {
+		err = w.publisher.publishFiles(titleHash, true)
+		if err != nil {
+			return err
+		}
+	}
+	return w.publishAll(index)
+}
+
+// publishPage uploads a public page and refreshes the site index.
+// If the set of public pages is changed, all pages are rendered again
+// to update links between them.
+func (w *Wikidata) publishPage(markdown *pageData) error {
+	w.publishLock.Lock()
+	defer w.publishLock.Unlock()
+
+	index, err := w.loadPublicIndex()
+	if err != nil {
+		return err
+	}
+	_, published := index.Pages[markdown.titleHash]
+	index.Pages[markdown.titleHash] = &publicPage{
+		Title:      markdown.title,
+		TitleHash:  markdown.titleHash,
+		LastUpdate: markdown.lastUpdate,
+	}
+	err = w.saveBare(index)
+	if err != nil {
+		return err
+	}
+
+	if !published {
+		return w.publishAll(index)
+	}
+	err = w.uploadHTML(markdown, index)
+	if err != nil {
+		return err
+	}
+
+	// Public pages including this page are rendered again.
+	includers, err := w.includers(markdown.titleHash)
+	if err != nil {
+		return err
+	}
+	for _, titleHash := range includers {
+		if _, ok := index.Pages[titleHash]; !ok {
+			continue
+		}
+		includer := &pageData{titleHash: titleHash}
+		err = w.loadBare(includer)
+		if err != nil {
+			return err
+		}
+		err = w.uploadHTML(includer, index)
+		if err != nil {
+			return err
+		}
+	}
+	return w.uploadSiteIndex(index)
+}
+
+// unpublishPage removes a page from the site index, and renders the
+// other pages again to strip links to it.
+func (w *Wikidata) unpublishPage(titleHash string) error {
+	w.publishLock.Lock()
+	defer w.publishLock.Unlock()
+
+	err := w.publisher.remove(w.publicHTMLPath(titleHash))
+	if err != nil {
+		return err
+	}
+
+	index, err := w.loadPublicIndex()
+	if err != nil {
+		return err
+	}
+	if _, ok := index.Pages[titleHash]; !ok {
+		return nil
+	}
+	delete(index.Pages, titleHash)
+	err = w.saveBare(index)
+	if err != nil {
+		return err
+	}
+	return w.publishAll(index)
+}
+
+func (w *Wikidata) publishAll(index *publicIndexData) error {
+	for titleHash := range index.Pages {
+		markdown := &pageData{titleHash: titleHash}
+		err := w.loadBare(markdown)
+		if err != nil {
+			return err
+		}
+		err = w.uploadHTML(markdown, index)
+		if err != nil {
+			return err
+		}
+	}
+	return w.uploadSiteIndex(index)
+}
+
+func (w *Wikidata) renderPublicHTML(markdown *pageData, index *publicIndexData) []byte {
+	return w.render(markdown, func(title string) (string, linkState) {
+		titleHash := w.titleHash(title)
+		if _, ok := index.Pages[titleHash]; !ok {
+			// Private page should not be linked from public.
+			return "", linkNone
+		}
+		return w.publicURL(titleHash), linkExists
+	}, w.publicLink(index), nil)
+}
+
+// publicLink rewrites links to public pages and their attachments, which are linked as
+// /page/<hash> and /page/<hash>/file/<filename> in markdown, to the published site.
+// Other links, including private pages, are kept as-is.
+func (w *Wikidata) publicLink(index *publicIndexData) urlRewriter {
+	return func(href string) string {
+		u, err := url.Parse(href)
+		if err != nil || u.Scheme != "" || u.Host != "" || !strings.HasPrefix(u.Path, "/page/") {
+			return href
+		}
+		path := strings.SplitN(strings.TrimPrefix(u.Path, "/page/"), "/", 2)
+		if _, ok := index.Pages[path[0]]; !ok {
+			return href
+		}
+		if len(path) == 2 && strings.HasPrefix(path[1], "file/") {
+			return w.publisher.baseURL() + href
+		}
+		if u.Fragment != "" {
+			return w.publicURL(path[0]) + "#" + u.Fragment
+		}
+		return w.publicURL(path[0])
+	}
+}
+
+func (w *Wikidata) uploadHTML(markdown *pageData, index *publicIndexData) error {
+	var buf bytes.Buffer
+	err := w.templates.ExecuteTemplate(&buf, "public.html", map[string]interface{}{
+		"Base":         w.publisher.baseURL(),
+		"Title":        markdown.title,
+		"Body":         template.HTML(w.renderPublicHTML(markdown, index)),
+		"Pages":        index.sorted(),
+		"LastModified": markdown.lastUpdate,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Attachments are published when the page becomes public, or they are added.
+	return w.publisher.put(w.publicHTMLPath(markdown.titleHash), buf.Bytes(), "text/html")
+}
+
+func (w *Wikidata) uploadSiteIndex(index *publicIndexData) error {
+	var buf bytes.Buffer
+	err := w.templates.ExecuteTemplate(&buf, "public_index.html", map[string]interface{}{
+		"Base":  w.publisher.baseURL(),
+		"Pages": index.sorted(),
+	})
+	if err != nil {
+		return err
+	}
+	err = w.publisher.put("index.html", buf.Bytes(), "text/html")
+	if err != nil {
+		return err
+	}
+	err = w.publisher.put("highlight.css", highlightCSS, "text/css")
+	if err != nil {
+		return err
+	}
+
+	sitemap, err := w.sitemap(index)
+	if err != nil {
+		return err
+	}
+	return w.publisher.put("sitemap.xml", sitemap, "application/xml")
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod"`
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+func (w *Wikidata) sitemap(index *publicIndexData) ([]byte, error) {
+	urlset := sitemapURLSet{}
+	for _, p := range index.sorted() {
+		urlset.URLs = append(urlset.URLs, sitemapURL{
+			Loc:     w.publicURL(p.TitleHash),
+			LastMod: p.LastUpdate.UTC().Format(time.RFC3339),
+		})
+	}
+	body, err := xml.MarshalIndent(urlset, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), body...), nil
+}
+
+func (index *publicIndexData) sorted() []*publicPage {
+	var pages []*publicPage
+	for _, p := range index.Pages {
+		pages = append(pages, p)
+	}
+	sort.Slice(pages, func(i, j int) bool {
+		return pages[i].Title < pages[j].Title
+	})
+	return pages
+}
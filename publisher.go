@@ -0,0 +1,254 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/labstack/echo"
+	"github.com/pkg/errors"
+)
+
+// publisher stores the generated public site.
+// path is slash-separated and relative to the site root, like "page/<hash>/index.html".
+type publisher interface {
+	baseURL() string
+	put(path string, body []byte, contentType string) error
+	remove(path string) error
+	// publishFiles makes attachments of the page visible or invisible from the site.
+	publishFiles(titleHash string, public bool) error
+	// publishFile makes a new attachment of public page visible from the site.
+	publishFile(file *fileData) error
+}
+
+// newPublisher returns the publisher for target, "s3", "server" or "dir".
+// If base is empty, the default URL of the target is used, "dir" has no default.
+func newPublisher(w *Wikidata, target, dir, base string) (publisher, error) {
+	base = strings.TrimSuffix(base, "/")
+	switch target {
+	case "", "s3":
+		if base == "" {
+			base = "http://" + w.bucket + ".s3-website-" + w.region + ".amazonaws.com"
+		}
+		return &s3Publisher{w: w, base: base}, nil
+	case "server":
+		if base == "" {
+			base = w.config.URL + "/public"
+		}
+		return &serverPublisher{w: w, base: base}, nil
+	case "dir":
+		if dir == "" {
+			return nil, errors.New("output directory is not set")
+		}
+		if base == "" {
+			return nil, errors.New("public URL is not set")
+		}
+		return &dirPublisher{w: w, dir: dir, base: base}, nil
+	}
+	return nil, errors.New("unknown publish target: " + target)
+}
+
+// s3Publisher writes public-read objects to the root of the bucket,
+// for S3 static website hosting.
+type s3Publisher struct {
+	w    *Wikidata
+	base string
+}
+
+func (p *s3Publisher) baseURL() string {
+	return p.base
+}
+
+func (p *s3Publisher) put(path string, body []byte, contentType string) error {
+	err := p.w.saveBare(&staticData{
+		path:        path,
+		body:        body,
+		contentType: contentType,
+	})
+	if err != nil {
+		return err
+	}
+	// ACL can be set only after the object is written.
+	if p.w.asyncWrites {
+		p.w.cacheStack[reflect.TypeOf(staticData{})].Sync()
+	}
+	return p.w.putacl(path, s3.ObjectCannedACLPublicRead)
+}
+
+func (p *s3Publisher) remove(path string) error {
+	return p.w.deleteBare(&staticData{path: path})
+}
+
+func (p *s3Publisher) publishFiles(titleHash string, public bool) error {
+	params := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(p.w.bucket),
+		MaxKeys:   aws.Int64(30),
+		Prefix:    aws.String("page/" + titleHash + "/file/"),
+		Delimiter: aws.String("/"),
+	}
+	resp, err := p.w.svc.ListObjectsV2(params)
+	if err != nil {
+		return err
+	}
+	for _, c := range resp.Contents {
+		if public {
+			err = p.w.putacl(*c.Key, s3.ObjectCannedACLPublicRead)
+		} else {
+			err = p.w.putacl(*c.Key, s3.ObjectCannedACLPrivate)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *s3Publisher) publishFile(file *fileData) error {
+	if p.w.asyncWrites {
+		p.w.cacheStack[reflect.TypeOf(fileData{})].Sync()
+	}
+	return p.w.putacl("page/"+file.titleHash+"/file/"+file.filename, s3.ObjectCannedACLPublicRead)
+}
+
+// serverPublisher keeps the site as private objects under "public/",
+// and the wiki serves them at /public/ without login.
+type serverPublisher struct {
+	w    *Wikidata
+	base string
+}
+
+func (p *serverPublisher) baseURL() string {
+	return p.base
+}
+
+func (p *serverPublisher) put(path string, body []byte, contentType string) error {
+	return p.w.saveBare(&staticData{
+		path:        "public/" + path,
+		body:        body,
+		contentType: contentType,
+	})
+}
+
+func (p *serverPublisher) remove(path string) error {
+	return p.w.deleteBare(&staticData{path: "public/" + path})
+}
+
+func (p *serverPublisher) publishFiles(titleHash string, public bool) error {
+	// Attachments are served by publicHandler, if the page is public.
+	return nil
+}
+
+func (p *serverPublisher) publishFile(file *fileData) error {
+	return nil
+}
+
+// dirPublisher writes the site to a local directory.
+type dirPublisher struct {
+	w    *Wikidata
+	dir  string
+	base string
+}
+
+func (p *dirPublisher) baseURL() string {
+	return p.base
+}
+
+func (p *dirPublisher) filepath(name string) string {
+	return filepath.Join(p.dir, filepath.FromSlash(path.Clean("/"+name)))
+}
+
+func (p *dirPublisher) put(name string, body []byte, contentType string) error {
+	filename := p.filepath(name)
+	err := os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, body, 0644)
+}
+
+func (p *dirPublisher) remove(name string) error {
+	err := os.Remove(p.filepath(name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (p *dirPublisher) publishFiles(titleHash string, public bool) error {
+	if !public {
+		err := os.RemoveAll(p.filepath("page/" + titleHash + "/file"))
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+
+	params := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(p.w.bucket),
+		MaxKeys:   aws.Int64(30),
+		Prefix:    aws.String("page/" + titleHash + "/file/"),
+		Delimiter: aws.String("/"),
+	}
+	resp, err := p.w.svc.ListObjectsV2(params)
+	if err != nil {
+		return err
+	}
+	for _, c := range resp.Contents {
+		file := &fileData{
+			filename:  path.Base(*c.Key),
+			titleHash: titleHash,
+		}
+		err = p.w.loadBare(file)
+		if err != nil {
+			return err
+		}
+		err = p.put(*c.Key, file.filebyte, file.contentType)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *dirPublisher) publishFile(file *fileData) error {
+	return p.put("page/"+file.titleHash+"/file/"+file.filename, file.filebyte, file.contentType)
+}
+
+// publicHandler serves the site of serverPublisher.
+func (h *handler) publicHandler(c echo.Context) (err error) {
+	name := path.Clean("/" + c.Param("*"))
+	if path.Ext(name) == "" {
+		name = path.Join(name, "index.html")
+	}
+	name = strings.TrimPrefix(name, "/")
+
+	// page/<hash>/file/<filename>
+	elem := strings.Split(name, "/")
+	if len(elem) == 4 && elem[0] == "page" && elem[2] == "file" {
+		if !h.db.checkPublic(elem[1]) {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		file := &fileData{
+			filename:  elem[3],
+			titleHash: elem[1],
+		}
+		err = h.db.with(c).loadBare(file)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		return c.Blob(http.StatusOK, file.contentType, file.filebyte)
+	}
+
+	static := &staticData{path: "public/" + name}
+	err = h.db.with(c).loadBare(static)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+	return c.Blob(http.StatusOK, static.contentType, static.body)
+}
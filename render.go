@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/russross/blackfriday"
+	"github.com/shurcooL/sanitized_anchor_name"
+)
+
+type linkState int
+
+const (
+	linkNone    linkState = iota // Not linked, label only
+	linkExists                   // Link to the page
+	linkMissing                  // Link to the page which doesn't exist yet
+)
+
+// linkResolver returns URL of the page and how it should be linked.
+type linkResolver func(title string) (url string, state linkState)
+
+// urlRewriter returns URL of the markdown link or image, such as attachments.
+type urlRewriter func(href string) string
+
+// wikiLink is [[Title]], [[Title|label]], [[Title#Section]] or [[Title#Section|label]]
+type wikiLink struct {
+	title   string
+	section string
+	label   string
+}
+
+var wikiLinkRegexp = regexp.MustCompile(`\[\[.*?\]\]`)
+
+func parseWikiLink(str string) wikiLink {
+	var link wikiLink
+	target := str
+	if i := strings.Index(str, "|"); i >= 0 {
+		target = str[:i]
+		link.label = strings.TrimSpace(str[i+1:])
+	}
+	link.title = strings.TrimSpace(target)
+	if i := strings.Index(target, "#"); i >= 0 {
+		link.title = strings.TrimSpace(target[:i])
+		link.section = strings.TrimSpace(target[i+1:])
+	}
+	if link.label == "" {
+		link.label = strings.TrimSpace(target)
+	}
+	return link
+}
+
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", `*`, `\*`, `_`, `\_`, `[`, `\[`, `]`, `\]`,
+)
+
+// mapOutsideCode applies f to the text of markdown, except fenced code blocks and code spans.
+func mapOutsideCode(body string, f func(text string) string) string {
+	var out bytes.Buffer
+	fence := ""
+	for _, line := range strings.SplitAfter(body, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case fence != "":
+			if strings.HasPrefix(trimmed, fence) {
+				fence = ""
+			}
+			out.WriteString(line)
+		case strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~"):
+			fence = trimmed[:3]
+			out.WriteString(line)
+		default:
+			for i, part := range strings.Split(line, "`") {
+				if i > 0 {
+					out.WriteString("`")
+				}
+				if i%2 == 1 {
+					out.WriteString(part)
+				} else {
+					out.WriteString(f(part))
+				}
+			}
+		}
+	}
+	return out.String()
+}
+
+// render returns inline HTML of the link, which is kept as-is by markdown.
+func (link wikiLink) render(resolve linkResolver) string {
+	label := markdownEscaper.Replace(html.EscapeString(link.label))
+	href, state := resolve(link.title)
+	if state == linkNone {
+		return label
+	}
+	if link.section != "" {
+		href += "#" + sanitized_anchor_name.Create(link.section)
+	}
+	class := ""
+	if state == linkMissing {
+		class = ` class="wikilink-new"`
+	}
+	return `<a href="` + html.EscapeString(href) + `"` + class + `>` + label + `</a>`
+}
+
+// pageLink resolves links to pages of the wiki.
+func (w *Wikidata) pageLink(title string) (string, linkState) {
+	titleHash := w.titleHash(title)
+	href := "/page/" + titleHash + "?title=" + url.QueryEscape(title)
+	if !w.pageExists(titleHash) {
+		return href, linkMissing
+	}
+	return href, linkExists
+}
+
+func (w *Wikidata) renderHTML(md *pageData) []byte {
+	return w.renderMarkdown(md, w.pageLink)
+}
+
+// renderOptions selects markdown extensions.
+type renderOptions struct {
+	headingIDs    bool // <h1 id="...">, required by toc
+	toc           bool // [[_TOC_]] macro
+	footnotes     bool
+	taskLists     bool // - [ ] and - [x]
+	strikethrough bool
+	tables        bool
+	highlight     bool // Syntax highlighting of fenced code block
+	diagrams      bool // mermaid, plantuml and graphviz code blocks as SVG
+	math          bool // $...$ and $$...$$ as MathML
+
+	policy *bluemonday.Policy // sanitizer for the extensions, built by parseRenderOptions
+}
+
+// parseRenderOptions parses comma-separated list of extensions,
+// like "headingids,toc,footnotes,tasklists,strikethrough,tables,highlight,diagrams,math".
+// "" enables everything, and "none" disables everything.
+func parseRenderOptions(str string) (renderOptions, error) {
+	if str == "" {
+		opts := renderOptions{true, true, true, true, true, true, true, true, true, nil}
+		opts.policy = sanitizePolicy(opts)
+		return opts, nil
+	}
+	var opts renderOptions
+	for _, ext := range strings.Split(str, ",") {
+		switch strings.ToLower(strings.TrimSpace(ext)) {
+		case "none":
+		case "headingids":
+			opts.headingIDs = true
+		case "toc":
+			opts.headingIDs = true
+			opts.toc = true
+		case "footnotes":
+			opts.footnotes = true
+		case "tasklists":
+			opts.taskLists = true
+		case "strikethrough":
+			opts.strikethrough = true
+		case "tables":
+			opts.tables = true
+		case "highlight":
+			opts.highlight = true
+		case "diagrams":
+			opts.diagrams = true
+		case "math":
+			opts.math = true
+		default:
+			return opts, errors.New("unknown markdown extension: " + ext)
+		}
+	}
+	opts.policy = sanitizePolicy(opts)
+	return opts, nil
+}
+
+const tocMarker = "BUCKETWIKITOCMARKER"
+
+// renderMarkdown converts includes and wiki links by resolve, and renders markdown of the page.
+func (w *Wikidata) renderMarkdown(md *pageData, resolve linkResolver) []byte {
+	return w.render(md, resolve, nil, nil)
+}
+
+// render is renderMarkdown, which rewrites URL of links and images by rewrite if it's not nil,
+// and renders diagrams not rendered yet if job is not nil.
+func (w *Wikidata) render(md *pageData, resolve linkResolver, rewrite urlRewriter, job *diagramJob) []byte {
+	opts := w.markdown
+
+	_, str := splitFrontMatter(md.body)
+	str = w.expandIncludes(str, resolve, []string{md.titleHash})
+	var maths []string
+	if opts.math {
+		str, maths = extractMath(str)
+	}
+	str = renderTags(str)
+	str = mapOutsideCode(str, func(text string) string {
+		return wikiLinkRegexp.ReplaceAllStringFunc(text, func(a string) string {
+			if a == "[[_TOC_]]" && opts.toc {
+				return tocMarker
+			}
+			return parseWikiLink(a[2 : len(a)-2]).render(resolve)
+		})
+	})
+
+	extensions := blackfriday.EXTENSION_NO_INTRA_EMPHASIS |
+		blackfriday.EXTENSION_FENCED_CODE |
+		blackfriday.EXTENSION_AUTOLINK |
+		blackfriday.EXTENSION_SPACE_HEADERS |
+		blackfriday.EXTENSION_HEADER_IDS |
+		blackfriday.EXTENSION_BACKSLASH_LINE_BREAK |
+		blackfriday.EXTENSION_DEFINITION_LISTS
+	htmlFlags := blackfriday.HTML_USE_XHTML |
+		blackfriday.HTML_USE_SMARTYPANTS |
+		blackfriday.HTML_SMARTYPANTS_FRACTIONS |
+		blackfriday.HTML_SMARTYPANTS_DASHES |
+		blackfriday.HTML_SMARTYPANTS_LATEX_DASHES
+	if opts.headingIDs {
+		extensions |= blackfriday.EXTENSION_AUTO_HEADER_IDS
+	}
+	if opts.footnotes {
+		extensions |= blackfriday.EXTENSION_FOOTNOTES
+		htmlFlags |= blackfriday.HTML_FOOTNOTE_RETURN_LINKS
+	}
+	if opts.strikethrough {
+		extensions |= blackfriday.EXTENSION_STRIKETHROUGH
+	}
+	if opts.tables {
+		extensions |= blackfriday.EXTENSION_TABLES
+	}
+
+	renderer := blackfriday.HtmlRenderer(htmlFlags, "", "")
+	if opts.highlight {
+		renderer = &highlightRenderer{renderer}
+	}
+	if opts.diagrams {
+		renderer = &diagramRenderer{Renderer: renderer, w: w, page: md, job: job, rewrite: rewrite}
+	}
+	if rewrite != nil {
+		renderer = &linkRenderer{Renderer: renderer, rewrite: rewrite}
+	}
+	unsafe := blackfriday.Markdown([]byte(str), renderer, extensions)
+	if opts.taskLists {
+		unsafe = renderTaskList(unsafe)
+	}
+
+	html := opts.policy.SanitizeBytes(unsafe)
+	if opts.toc {
+		html = renderTOC(html)
+	}
+	if opts.math {
+		html = replaceMath(html, maths)
+	}
+	return html
+}
+
+// linkRenderer rewrites URL of links and images, code is not changed.
+type linkRenderer struct {
+	blackfriday.Renderer
+	rewrite urlRewriter
+}
+
+func (r *linkRenderer) Link(out *bytes.Buffer, link []byte, title []byte, content []byte) {
+	r.Renderer.Link(out, []byte(r.rewrite(string(link))), title, content)
+}
+
+func (r *linkRenderer) Image(out *bytes.Buffer, link []byte, title []byte, alt []byte) {
+	r.Renderer.Image(out, []byte(r.rewrite(string(link))), title, alt)
+}
+
+var taskListRegexp = regexp.MustCompile(`<li>(<p>)?\[([ xX])\] `)
+
+func renderTaskList(html []byte) []byte {
+	return taskListRegexp.ReplaceAllFunc(html, func(a []byte) []byte {
+		m := taskListRegexp.FindSubmatch(a)
+		checkbox := `<input type="checkbox" disabled="">`
+		if string(m[2]) != " " {
+			checkbox = `<input type="checkbox" checked="" disabled="">`
+		}
+		return []byte(`<li class="task-list-item">` + string(m[1]) + checkbox + " ")
+	})
+}
+
+var (
+	headingRegexp = regexp.MustCompile(`<h([1-6]) id="([^"]+)">(.*?)</h[1-6]>`)
+	tagRegexp     = regexp.MustCompile(`<[^>]*>`)
+)
+
+// renderTOC replaces the marker with the list of headings.
+// html must be sanitized, because heading text is used as-is.
+func renderTOC(html []byte) []byte {
+	headings := headingRegexp.FindAllSubmatch(html, -1)
+	top := 6
+	for _, m := range headings {
+		if level := int(m[1][0] - '0'); level < top {
+			top = level
+		}
+	}
+
+	var toc bytes.Buffer
+	toc.WriteString(`<div class="toc">`)
+	depth := 0
+	for _, m := range headings {
+		level := int(m[1][0]-'0') - top + 1
+		if level > depth {
+			for ; depth < level; depth++ {
+				toc.WriteString("<ul><li>")
+			}
+		} else {
+			for ; depth > level; depth-- {
+				toc.WriteString("</li></ul>")
+			}
+			toc.WriteString("</li><li>")
+		}
+		toc.WriteString(`<a href="#` + string(m[2]) + `">`)
+		toc.Write(tagRegexp.ReplaceAll(m[3], nil))
+		toc.WriteString("</a>")
+	}
+	for ; depth > 0; depth-- {
+		toc.WriteString("</li></ul>")
+	}
+	toc.WriteString("</div>")
+
+	html = bytes.Replace(html, []byte("<p>"+tocMarker+"</p>"), toc.Bytes(), -1)
+	return bytes.Replace(html, []byte(tocMarker), toc.Bytes(), -1)
+}
+
+var (
+	idRegexp       = regexp.MustCompile(`^[a-zA-Z0-9\:\-_\.]+$`)
+	checkboxRegexp = regexp.MustCompile(`^checkbox$`)
+	emptyRegexp    = regexp.MustCompile(`^$`)
+)
+
+// sanitizePolicy allows exactly the constructs generated by renderMarkdown with opts.
+// It's built once by parseRenderOptions, because building it for each page is slow.
+func sanitizePolicy(opts renderOptions) *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+
+	// Regular expressions of allowed class for each element.
+	classes := map[string][]string{
+		"a":    {"wikilink-new"},
+		"span": {"tag"},
+	}
+	if opts.headingIDs {
+		p.AllowAttrs("id").Matching(idRegexp).OnElements("h1", "h2", "h3", "h4", "h5", "h6")
+	}
+	if opts.footnotes {
+		p.AllowAttrs("id").Matching(idRegexp).OnElements("sup", "li")
+		classes["sup"] = append(classes["sup"], "footnote-ref")
+		classes["div"] = append(classes["div"], "footnotes")
+		classes["a"] = append(classes["a"], "footnote-return")
+	}
+	if opts.taskLists {
+		p.AllowElements("input")
+		p.AllowAttrs("type").Matching(checkboxRegexp).OnElements("input")
+		p.AllowAttrs("checked", "disabled").Matching(emptyRegexp).OnElements("input")
+		classes["li"] = append(classes["li"], "task-list-item")
+	}
+	// Tables and strikethrough are allowed by UGCPolicy.
+	if opts.highlight {
+		classes["pre"] = append(classes["pre"], highlightPrefix+"chroma")
+		classes["span"] = append(classes["span"], highlightPrefix+"[a-z0-9]+", highlightPrefix+"line "+highlightPrefix+"hl")
+	}
+	if opts.diagrams {
+		classes["img"] = append(classes["img"], "diagram")
+	}
+	// MathML is inserted after sanitizing.
+
+	for element, list := range classes {
+		p.AllowAttrs("class").Matching(regexp.MustCompile(`^(` + strings.Join(list, "|") + `)$`)).OnElements(element)
+	}
+	return p
+}
@@ -3,16 +3,18 @@ package main
 import (
 	"crypto/sha256"
 	"fmt"
-	"os"
+	"html/template"
 	"reflect"
 	"strings"
+	"sync"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/juntaki/transparent"
-	"github.com/juntaki/transparent/lru"
 	ts3 "github.com/juntaki/transparent/s3"
 )
 
@@ -22,8 +24,38 @@ type Wikidata struct {
 	bucket     string
 	region     string
 	wikiSecret string
+	config     *config
 	cacheStack map[reflect.Type]*transparent.Stack
 	bareStack  *transparent.Stack
+
+	caches      map[reflect.Type]*cache
+	cacheConfig map[string]cacheConfig // by cacheName, nil for defaults
+	invalidator invalidator            // nil for a single instance
+	instanceID  string
+	asyncWrites bool // DURABILITY=async
+
+	templates   *template.Template
+	markdown    renderOptions
+	publisher   publisher
+	publishLock sync.Mutex
+
+	pagesLock sync.Mutex
+	pages     map[string]bool // titleHash of existing pages, loaded lazily
+	indexLock sync.Mutex      // for indexes of pages, such as titleIndexData
+	rebuilt   map[string]bool // titleHash of pages updated while rebuilding indexes, nil if not rebuilding
+
+	notifiers  []notifier
+	notifyLock sync.Mutex // for watchData and notificationData
+
+	webhookLock sync.Mutex // for webhookData, deliveryLogData and retries
+	retries     []*pendingDelivery
+	deliveries  sync.WaitGroup // Deliveries in progress
+
+	jobs *jobRunner
+
+	diagrams     *cache // Existence of rendered diagrams
+	diagramLock  sync.Mutex
+	diagramQueue map[string]bool // titleHash of pages to render diagrams
 }
 
 func (w *Wikidata) titleHash(title string) string {
@@ -31,7 +63,114 @@ func (w *Wikidata) titleHash(title string) string {
 }
 
 func (w *Wikidata) publicURL(titleHash string) string {
-	return "http://" + w.bucket + ".s3-website-" + w.region + ".amazonaws.com/page/" + titleHash
+	return w.publisher.baseURL() + w.publicPath(titleHash)
+}
+
+func (w *Wikidata) pageExists(titleHash string) bool {
+	w.pagesLock.Lock()
+	defer w.pagesLock.Unlock()
+
+	if w.pages == nil {
+		list, err := w.list()
+		if err != nil {
+			log.WithField("error", err.Error()).Error("list pages failed")
+			return true
+		}
+		w.pages = make(map[string]bool)
+		for _, t := range list {
+			w.pages[t] = true
+		}
+	}
+	return w.pages[titleHash]
+}
+
+func (w *Wikidata) setPageExists(titleHash string, exists bool) {
+	w.pagesLock.Lock()
+	defer w.pagesLock.Unlock()
+
+	if w.pages == nil {
+		// Not loaded yet, it will be loaded with this change.
+		return
+	}
+	if exists {
+		w.pages[titleHash] = true
+	} else {
+		delete(w.pages, titleHash)
+	}
+}
+
+// forEachPage calls f with every page, to rebuild indexes.
+func (w *Wikidata) forEachPage(f func(markdown *pageData)) error {
+	titleHashes, err := w.list()
+	if err != nil {
+		return err
+	}
+	for _, titleHash := range titleHashes {
+		markdown := &pageData{titleHash: titleHash}
+		err = w.loadBare(markdown)
+		if err != nil {
+			continue
+		}
+		f(markdown)
+	}
+	return nil
+}
+
+// loadTitleIndex returns titles of all pages.
+func (w *Wikidata) loadTitleIndex() (*titleIndexData, error) {
+	index := &titleIndexData{}
+	err := w.loadBare(index)
+	if err == nil {
+		return index, nil
+	}
+
+	// First access or broken index, scan pages to recover it.
+	log.WithField("error", err.Error()).Warn("title index not found, rebuild")
+	index.Titles = make(map[string]string)
+	err = w.forEachPage(func(markdown *pageData) {
+		index.Titles[markdown.titleHash] = markdown.title
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = w.saveBare(index)
+	if err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// titles returns titleHash -> title of all pages.
+func (w *Wikidata) titles() (map[string]string, error) {
+	w.indexLock.Lock()
+	defer w.indexLock.Unlock()
+
+	index, err := w.loadTitleIndex()
+	if err != nil {
+		return nil, err
+	}
+	return index.Titles, nil
+}
+
+// setPageTitle updates the title index. Empty title removes the page.
+func (w *Wikidata) setPageTitle(titleHash, title string) error {
+	w.indexLock.Lock()
+	defer w.indexLock.Unlock()
+
+	index, err := w.loadTitleIndex()
+	if err != nil {
+		return err
+	}
+	w.indexUpdated(titleHash)
+	if index.Titles[titleHash] == title {
+		return nil
+	}
+	if title == "" {
+		delete(index.Titles, titleHash)
+	} else {
+		index.Titles[titleHash] = title
+	}
+	return w.saveBare(index)
 }
 
 func (w *Wikidata) checkPublic(titleHash string) bool {
@@ -47,7 +186,7 @@ func (w *Wikidata) checkPublic(titleHash string) bool {
 }
 
 func (w *Wikidata) setACL(titleHash string, public bool) error {
-	// public: Upload HTML and set file permission as public
+	// public: Publish HTML and set file permission as public
 	// private: Delete HTML and set file permission as private
 	var err error
 
@@ -60,47 +199,24 @@ func (w *Wikidata) setACL(titleHash string, public bool) error {
 		return nil
 	}
 
-	if public {
-		markdown.public = true
-		err = w.uploadHTML(markdown)
-		if err != nil {
-			return err
-		}
-	} else {
-		markdown.public = false
-		html := &htmlData{titleHash: titleHash}
-		err := w.deleteBare(html)
-		if err != nil {
-			return err
-		}
-	}
-
+	markdown.public = public
 	err = w.saveBare(markdown)
 	if err != nil {
 		return err
 	}
 
-	params := &s3.ListObjectsV2Input{
-		Bucket:    aws.String(w.bucket),
-		MaxKeys:   aws.Int64(30),
-		Prefix:    aws.String("page/" + titleHash + "/file/"),
-		Delimiter: aws.String("/"),
-	}
-	resp, err := w.svc.ListObjectsV2(params)
-	if err != nil {
-		return err
-	}
-	for _, c := range resp.Contents {
-		if public {
-			err = w.putacl(*c.Key, s3.ObjectCannedACLPublicRead)
-		} else {
-			err = w.putacl(*c.Key, s3.ObjectCannedACLPrivate)
+	if public {
+		err = w.publishPage(markdown)
+		if err != nil {
+			return err
 		}
+	} else {
+		err = w.unpublishPage(titleHash)
 		if err != nil {
 			return err
 		}
 	}
-	return nil
+	return w.publisher.publishFiles(titleHash, public)
 }
 
 func (w *Wikidata) head(key string) (map[string]*string, error) {
@@ -138,23 +254,30 @@ func (w *Wikidata) getacl(key string) (*s3.GetObjectAclOutput, error) {
 	return w.svc.GetObjectAcl(params)
 }
 
+// list returns titleHash of all pages.
 func (w *Wikidata) list() ([]string, error) {
 	params := &s3.ListObjectsV2Input{
 		Bucket:    aws.String(w.bucket),
-		MaxKeys:   aws.Int64(30),
+		MaxKeys:   aws.Int64(1000),
 		Prefix:    aws.String("page/"),
 		Delimiter: aws.String("/"),
 	}
-	resp, err := w.svc.ListObjectsV2(params)
-	if err != nil {
-		return nil, err
-	}
 
 	var result []string
-	for _, c := range resp.CommonPrefixes {
-		item := strings.TrimRight(*c.Prefix, "/")
-		item = strings.TrimLeft(item, "page/")
-		result = append(result, item)
+	for {
+		resp, err := w.svc.ListObjectsV2(params)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range resp.CommonPrefixes {
+			item := strings.TrimSuffix(*c.Prefix, "/")
+			item = strings.TrimPrefix(item, "page/")
+			result = append(result, item)
+		}
+		if resp.IsTruncated == nil || !*resp.IsTruncated {
+			break
+		}
+		params.ContinuationToken = resp.NextContinuationToken
 	}
 	return result, nil
 }
@@ -183,11 +306,16 @@ func (w *Wikidata) connect() error {
 	if err != nil {
 		return err
 	}
-	w.svc = s3.New(sess, &aws.Config{
+	awsConfig := &aws.Config{
 		Region: aws.String(w.region),
-	})
+	}
+	if w.config.Storage.AccessKeyID != "" {
+		awsConfig.Credentials = credentials.NewStaticCredentials(
+			w.config.Storage.AccessKeyID, w.config.Storage.SecretAccessKey, "")
+	}
+	w.svc = &instrumentedS3{s3.New(sess, awsConfig)}
 
-	w.wikiSecret = os.Getenv("WIKI_SECRET")
+	w.wikiSecret = w.config.Secret
 
 	err = w.initializeCache()
 	if err != nil {
@@ -196,6 +324,28 @@ func (w *Wikidata) connect() error {
 	return nil
 }
 
+// cachedTypes are the data types with a cache and a stack.
+var cachedTypes = []reflect.Type{
+	reflect.TypeOf(pageData{}),
+	reflect.TypeOf(userData{}),
+	reflect.TypeOf(fileData{}),
+	reflect.TypeOf(sessionData{}),
+	reflect.TypeOf(publicIndexData{}),
+	reflect.TypeOf(staticData{}),
+	reflect.TypeOf(shareData{}),
+	reflect.TypeOf(titleIndexData{}),
+	reflect.TypeOf(includeIndexData{}),
+	reflect.TypeOf(tagIndexData{}),
+	reflect.TypeOf(metaIndexData{}),
+	reflect.TypeOf(changeData{}),
+	reflect.TypeOf(feedTokenData{}),
+	reflect.TypeOf(watchData{}),
+	reflect.TypeOf(notificationData{}),
+	reflect.TypeOf(webhookData{}),
+	reflect.TypeOf(deliveryLogData{}),
+	reflect.TypeOf(auditData{}),
+}
+
 func (w *Wikidata) initializeCache() error {
 	bare, err := ts3.NewBareSource(w.svc)
 	if err != nil {
@@ -207,22 +357,21 @@ func (w *Wikidata) initializeCache() error {
 	w.bareStack.Start()
 
 	w.cacheStack = make(map[reflect.Type]*transparent.Stack)
-	w.newCacheStack(bare, reflect.TypeOf(pageData{}))
-	w.newCacheStack(bare, reflect.TypeOf(htmlData{}))
-	w.newCacheStack(bare, reflect.TypeOf(userData{}))
-	w.newCacheStack(bare, reflect.TypeOf(fileData{}))
-	w.newCacheStack(bare, reflect.TypeOf(sessionData{}))
+	w.caches = make(map[reflect.Type]*cache)
+	w.diagrams = newCache("diagram", w.cacheConfigOf("diagram"))
+	for _, t := range cachedTypes {
+		w.newCacheStack(bare, t)
+	}
 	return nil
 }
 
+// newCacheStack creates the stack of type t, and its cache configured by cacheConfig.
 func (w *Wikidata) newCacheStack(bare transparent.Layer, t reflect.Type) error {
-	lruL, err := lru.NewCache(10, 10)
-	if err != nil {
-		return err
-	}
 	w.cacheStack[t] = transparent.NewStack()
 	w.cacheStack[t].Stack(bare)
-	w.cacheStack[t].Stack(lruL)
 	w.cacheStack[t].Start()
+
+	name := cacheName(t)
+	w.caches[t] = newCache(name, w.cacheConfigOf(name))
 	return nil
 }
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// "bucketwiki setup" checks the bucket is configured for the wiki.
+//   versioning  History of pages is kept as versions of objects.
+//   website     Public pages are served by static website hosting, for s3 publish target.
+//   cors        Browsers on URL can read and write objects, for the editor.
+//   lifecycle   Sessions and invalidation markers expire, and old versions if -version-days is set.
+// With -apply, misconfigured settings are fixed, keeping other settings of the bucket.
+// The server runs the same checks at startup, and warns problems.
+
+// Rules of the wiki are named with lifecyclePrefix, to replace them by setup.
+const (
+	lifecyclePrefix       = "bucketwiki-"
+	lifecycleVersions     = lifecyclePrefix + "old-versions"
+	lifecycleSessions     = lifecyclePrefix + "sessions"
+	lifecycleInvalidation = lifecyclePrefix + "invalidation"
+)
+
+// versionPrefixes are rewritten often, and their old versions are not history of pages.
+var versionPrefixes = []string{"index/", "publish/", "public/", "notification/", "admin/", "user/"}
+
+type setupOptions struct {
+	versionDays  int64 // Days to keep old versions, 0 to keep forever
+	versionPages bool  // Old versions of pages also expire, which deletes history
+	sessionDays  int64 // Days to keep sessions, 0 to keep forever
+}
+
+var defaultSetupOptions = setupOptions{sessionDays: 30}
+
+type setupCheck struct {
+	Name    string
+	Problem string // Empty if it's ok
+	Skipped string // Reason to skip
+	Fixed   bool
+	Error   error // Check or fix failed
+	fix     func() error
+}
+
+func (sc *setupCheck) ok() bool {
+	return sc.Error == nil && (sc.Problem == "" || sc.Fixed)
+}
+
+func (sc *setupCheck) message() string {
+	switch {
+	case sc.Error != nil:
+		return "error: " + sc.Error.Error()
+	case sc.Skipped != "":
+		return "skipped: " + sc.Skipped
+	case sc.Fixed:
+		return "fixed: " + sc.Problem
+	case sc.Problem != "":
+		return "NG: " + sc.Problem
+	}
+	return "ok"
+}
+
+func (sc *setupCheck) String() string {
+	return fmt.Sprintf("%-10s %s", sc.Name, sc.message())
+}
+
+func errorCode(err error) string {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code()
+	}
+	return ""
+}
+
+// runSetup checks the bucket, and fixes problems if apply is true.
+func (w *Wikidata) runSetup(o setupOptions, apply bool) []*setupCheck {
+	checks := []*setupCheck{
+		w.checkVersioning(),
+		w.checkWebsite(),
+		w.checkCORS(),
+		w.checkLifecycle(o),
+	}
+	if apply {
+		for _, sc := range checks {
+			if sc.Error == nil && sc.Problem != "" {
+				sc.Error = sc.fix()
+				sc.Fixed = sc.Error == nil
+			}
+		}
+	}
+	return checks
+}
+
+func (w *Wikidata) checkVersioning() *setupCheck {
+	sc := &setupCheck{Name: "versioning"}
+	out, err := w.svc.GetBucketVersioning(&s3.GetBucketVersioningInput{Bucket: aws.String(w.bucket)})
+	if err != nil {
+		sc.Error = err
+		return sc
+	}
+	if aws.StringValue(out.Status) != s3.BucketVersioningStatusEnabled {
+		sc.Problem = "versioning is not enabled, history of pages is not kept"
+		sc.fix = func() error {
+			_, err := w.svc.PutBucketVersioning(&s3.PutBucketVersioningInput{
+				Bucket: aws.String(w.bucket),
+				VersioningConfiguration: &s3.VersioningConfiguration{
+					Status: aws.String(s3.BucketVersioningStatusEnabled),
+				},
+			})
+			return err
+		}
+	}
+	return sc
+}
+
+func (w *Wikidata) checkWebsite() *setupCheck {
+	sc := &setupCheck{Name: "website"}
+	if target := w.config.Publish.Target; target != "" && target != "s3" {
+		sc.Skipped = "publish target is " + target
+		return sc
+	}
+	out, err := w.svc.GetBucketWebsite(&s3.GetBucketWebsiteInput{Bucket: aws.String(w.bucket)})
+	if err != nil && errorCode(err) != "NoSuchWebsiteConfiguration" {
+		sc.Error = err
+		return sc
+	}
+	if err == nil && out.IndexDocument != nil && aws.StringValue(out.IndexDocument.Suffix) == "index.html" {
+		return sc
+	}
+
+	sc.Problem = "website hosting is not enabled with index.html, public pages are not served"
+	website := &s3.WebsiteConfiguration{
+		IndexDocument: &s3.IndexDocument{Suffix: aws.String("index.html")},
+	}
+	if err == nil {
+		website.ErrorDocument = out.ErrorDocument
+		website.RoutingRules = out.RoutingRules
+	}
+	sc.fix = func() error {
+		_, err := w.svc.PutBucketWebsite(&s3.PutBucketWebsiteInput{
+			Bucket:               aws.String(w.bucket),
+			WebsiteConfiguration: website,
+		})
+		return err
+	}
+	return sc
+}
+
+var corsMethods = []string{"GET", "HEAD", "PUT"}
+
+// corsAllows returns true if the rule allows all of corsMethods from origin.
+func corsAllows(rule *s3.CORSRule, origin string) bool {
+	allowed := false
+	for _, o := range rule.AllowedOrigins {
+		allowed = allowed || *o == origin || *o == "*"
+	}
+	for _, method := range corsMethods {
+		found := false
+		for _, m := range rule.AllowedMethods {
+			found = found || *m == method
+		}
+		allowed = allowed && found
+	}
+	return allowed
+}
+
+func (w *Wikidata) checkCORS() *setupCheck {
+	sc := &setupCheck{Name: "cors"}
+	var rules []*s3.CORSRule
+	out, err := w.svc.GetBucketCors(&s3.GetBucketCorsInput{Bucket: aws.String(w.bucket)})
+	switch {
+	case err == nil:
+		rules = out.CORSRules
+	case errorCode(err) != "NoSuchCORSConfiguration":
+		sc.Error = err
+		return sc
+	}
+	for _, rule := range rules {
+		if corsAllows(rule, w.config.URL) {
+			return sc
+		}
+	}
+
+	sc.Problem = "CORS does not allow the editor on " + w.config.URL
+	rules = append(rules, &s3.CORSRule{
+		AllowedOrigins: []*string{aws.String(w.config.URL)},
+		AllowedMethods: aws.StringSlice(corsMethods),
+		AllowedHeaders: []*string{aws.String("*")},
+		MaxAgeSeconds:  aws.Int64(3000),
+	})
+	sc.fix = func() error {
+		_, err := w.svc.PutBucketCors(&s3.PutBucketCorsInput{
+			Bucket:            aws.String(w.bucket),
+			CORSConfiguration: &s3.CORSConfiguration{CORSRules: rules},
+		})
+		return err
+	}
+	return sc
+}
+
+// lifecycleRules returns rules which the wiki needs.
+func (w *Wikidata) lifecycleRules(o setupOptions) []*s3.LifecycleRule {
+	var rules []*s3.LifecycleRule
+	rule := func(id, prefix string) *s3.LifecycleRule {
+		r := &s3.LifecycleRule{
+			ID:     aws.String(id),
+			Filter: &s3.LifecycleRuleFilter{Prefix: aws.String(prefix)},
+			Status: aws.String(s3.ExpirationStatusEnabled),
+		}
+		rules = append(rules, r)
+		return r
+	}
+	if o.versionDays > 0 {
+		prefixes := versionPrefixes
+		if o.versionPages {
+			prefixes = []string{""}
+		}
+		for _, prefix := range prefixes {
+			id := lifecycleVersions
+			if prefix != "" {
+				id += "-" + strings.TrimSuffix(prefix, "/")
+			}
+			rule(id, prefix).NoncurrentVersionExpiration = &s3.NoncurrentVersionExpiration{
+				NoncurrentDays: aws.Int64(o.versionDays),
+			}
+		}
+	}
+	// Expiration only adds delete markers to the versioned bucket,
+	// so noncurrent versions also expire.
+	expire := func(r *s3.LifecycleRule, days int64) {
+		r.Expiration = &s3.LifecycleExpiration{Days: aws.Int64(days)}
+		r.NoncurrentVersionExpiration = &s3.NoncurrentVersionExpiration{NoncurrentDays: aws.Int64(1)}
+	}
+	if o.sessionDays > 0 {
+		expire(rule(lifecycleSessions, "session/"), o.sessionDays)
+	}
+	if w.config.Cache.Invalidation == "s3" {
+		// Markers are polled only for a minute.
+		expire(rule(lifecycleInvalidation, invalidationPrefix), 1)
+	}
+	return rules
+}
+
+// lifecycleSummary returns the settings of the rule, to compare rules.
+func lifecycleSummary(r *s3.LifecycleRule) string {
+	prefix := aws.StringValue(r.Prefix)
+	if r.Filter != nil {
+		prefix = aws.StringValue(r.Filter.Prefix)
+	}
+	var days, noncurrentDays int64
+	if r.Expiration != nil {
+		days = aws.Int64Value(r.Expiration.Days)
+	}
+	if r.NoncurrentVersionExpiration != nil {
+		noncurrentDays = aws.Int64Value(r.NoncurrentVersionExpiration.NoncurrentDays)
+	}
+	return fmt.Sprintf("%s prefix=%q days=%d noncurrentDays=%d", aws.StringValue(r.Status), prefix, days, noncurrentDays)
+}
+
+func (w *Wikidata) checkLifecycle(o setupOptions) *setupCheck {
+	sc := &setupCheck{Name: "lifecycle"}
+	want := w.lifecycleRules(o)
+	if len(want) == 0 {
+		sc.Skipped = "no rules are needed"
+		return sc
+	}
+
+	var rules []*s3.LifecycleRule
+	out, err := w.svc.GetBucketLifecycleConfiguration(&s3.GetBucketLifecycleConfigurationInput{Bucket: aws.String(w.bucket)})
+	switch {
+	case err == nil:
+		rules = out.Rules
+	case errorCode(err) != "NoSuchLifecycleConfiguration":
+		sc.Error = err
+		return sc
+	}
+
+	existing := make(map[string]*s3.LifecycleRule)
+	for _, r := range rules {
+		existing[aws.StringValue(r.ID)] = r
+	}
+	var missing []string
+	for _, r := range want {
+		e, ok := existing[*r.ID]
+		if !ok || lifecycleSummary(e) != lifecycleSummary(r) {
+			missing = append(missing, *r.ID)
+		}
+	}
+	if len(missing) == 0 {
+		return sc
+	}
+
+	sc.Problem = fmt.Sprintf("rules %v are missing or different", missing)
+	var merged []*s3.LifecycleRule
+	for _, r := range rules {
+		// Rules of the wiki are replaced by the wanted rules, or removed if they are not needed.
+		if !strings.HasPrefix(aws.StringValue(r.ID), lifecyclePrefix) {
+			merged = append(merged, r)
+		}
+	}
+	merged = append(merged, want...)
+	sc.fix = func() error {
+		_, err := w.svc.PutBucketLifecycleConfiguration(&s3.PutBucketLifecycleConfigurationInput{
+			Bucket:                 aws.String(w.bucket),
+			LifecycleConfiguration: &s3.BucketLifecycleConfiguration{Rules: merged},
+		})
+		return err
+	}
+	return sc
+}
+
+// warnSetup logs problems of the bucket at startup.
+// Lifecycle of old versions and sessions is up to "bucketwiki setup".
+func (w *Wikidata) warnSetup() {
+	for _, sc := range w.runSetup(setupOptions{}, false) {
+		if !sc.ok() {
+			log.WithField("check", sc.Name).Warn(sc.message() + ", run \"bucketwiki setup -apply\" to fix")
+		}
+	}
+}
+
+// setupCommand runs "bucketwiki setup [-apply] [flags]".
+func setupCommand(args []string) int {
+	fs := flag.NewFlagSet("setup", flag.ContinueOnError)
+	apply := fs.Bool("apply", false, "fix misconfigured settings of the bucket")
+	o := defaultSetupOptions
+	fs.Int64Var(&o.versionDays, "version-days", o.versionDays, "days to keep old versions except pages, 0 to keep forever")
+	fs.BoolVar(&o.versionPages, "version-pages", false, "old versions of pages also expire by -version-days, which deletes history")
+	fs.Int64Var(&o.sessionDays, "session-days", o.sessionDays, "days to keep sessions, 0 to keep forever")
+	c, err := loadConfig(fs, args, os.LookupEnv)
+	if err == nil && (o.versionDays < 0 || o.sessionDays < 0) {
+		err = errors.New("days should not be negative")
+	}
+	if err == nil && o.versionPages && o.versionDays == 0 {
+		err = errors.New("-version-pages requires -version-days")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	w := &Wikidata{
+		bucket: c.Storage.Bucket,
+		region: c.Storage.Region,
+		config: c,
+	}
+	err = w.connect()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	status := 0
+	for _, sc := range w.runSetup(o, *apply) {
+		fmt.Println(sc)
+		if !sc.ok() {
+			status = 1
+		}
+	}
+	if status != 0 && !*apply {
+		fmt.Println("run with -apply to fix")
+	}
+	return status
+}
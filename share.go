@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/labstack/echo"
+)
+
+// Share link is /share/<titleHash>/<id>.<signature>
+// It's read-only and valid until expiration or revocation (deletion of shareData).
+
+var shareDurations = map[string]time.Duration{
+	"1h":  time.Hour,
+	"1d":  24 * time.Hour,
+	"7d":  7 * 24 * time.Hour,
+	"30d": 30 * 24 * time.Hour,
+}
+
+func (w *Wikidata) shareSignature(titleHash, id string) string {
+	mac := hmac.New(sha256.New, []byte(w.wikiSecret))
+	mac.Write([]byte(titleHash + "/" + id))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *Wikidata) shareToken(share *shareData) string {
+	return share.ID + "." + w.shareSignature(share.TitleHash, share.ID)
+}
+
+// loadShare validates token and returns the share.
+func (w *Wikidata) loadShare(titleHash, token string) (*shareData, error) {
+	elem := strings.SplitN(token, ".", 2)
+	if len(elem) != 2 ||
+		!hmac.Equal([]byte(elem[1]), []byte(w.shareSignature(titleHash, elem[0]))) {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "invalid share link")
+	}
+
+	share := &shareData{
+		ID:        elem[0],
+		TitleHash: titleHash,
+	}
+	err := w.loadBare(share)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "share link is revoked")
+	}
+	if share.expired(time.Now()) {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "share link is expired")
+	}
+	return share, nil
+}
+
+func (w *Wikidata) listShare(titleHash string) ([]*shareData, error) {
+	params := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(w.bucket),
+		MaxKeys: aws.Int64(1000),
+		Prefix:  aws.String("page/" + titleHash + "/share/"),
+	}
+	resp, err := w.svc.ListObjectsV2(params)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*shareData
+	for _, c := range resp.Contents {
+		share := &shareData{
+			ID:        strings.TrimPrefix(*c.Key, *params.Prefix),
+			TitleHash: titleHash,
+		}
+		err = w.loadBare(share)
+		if err != nil {
+			continue
+		}
+		result = append(result, share)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Created.After(result[j].Created)
+	})
+	return result, nil
+}
+
+func (h *handler) shareListHandler(c echo.Context) (err error) {
+	titleHash := c.Param("titleHash")
+	title := c.QueryParam("title")
+
+	shares, err := h.db.listShare(titleHash)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var list []map[string]interface{}
+	for _, share := range shares {
+		list = append(list, map[string]interface{}{
+			"ID":      share.ID,
+			"URL":     h.db.config.URL + "/share/" + titleHash + "/" + h.db.shareToken(share),
+			"Creator": share.Creator,
+			"Created": share.Created,
+			"Expires": share.Expires,
+			"Expired": share.expired(now),
+			"Files":   share.Files,
+		})
+	}
+
+	return c.Render(http.StatusOK, "share.html", map[string]interface{}{
+		"Title":     title,
+		"TitleHash": titleHash,
+		"List":      list,
+	})
+}
+
+func (h *handler) createShareHandler(c echo.Context) (err error) {
+	titleHash := c.Param("titleHash")
+	duration, ok := shareDurations[c.FormValue("expires")]
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, "unknown expiration")
+	}
+
+	md := &pageData{titleHash: titleHash}
+	err = h.db.with(c).loadBare(md)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "page not found")
+	}
+
+	id, err := randomString()
+	if err != nil {
+		return err
+	}
+	sess := c.Get("session").(*sessionData)
+	now := time.Now()
+	share := &shareData{
+		ID:        id,
+		TitleHash: titleHash,
+		Creator:   sess.User,
+		Created:   now,
+		Expires:   now.Add(duration),
+		Files:     c.FormValue("files") == "true",
+	}
+	err = h.db.with(c).saveBare(share)
+	if err != nil {
+		return err
+	}
+	h.audit(c, &auditData{Action: auditShareCreate, Target: md.title, Detail: "expires " + share.Expires.Format(time.RFC3339), Success: true})
+	return c.Redirect(http.StatusFound, "/page/"+titleHash+"/share?title="+url.QueryEscape(md.title))
+}
+
+func (h *handler) revokeShareHandler(c echo.Context) (err error) {
+	titleHash := c.Param("titleHash")
+	share := &shareData{
+		ID:        c.Param("id"),
+		TitleHash: titleHash,
+	}
+	err = h.db.with(c).deleteBare(share)
+	if err != nil {
+		return err
+	}
+	h.audit(c, &auditData{Action: auditShareRevoke, Target: c.FormValue("title"), Success: true})
+	return c.Redirect(http.StatusFound, "/page/"+titleHash+"/share?title="+url.QueryEscape(c.FormValue("title")))
+}
+
+// sharedPageHandler shows the page without login.
+func (h *handler) sharedPageHandler(c echo.Context) (err error) {
+	titleHash := c.Param("titleHash")
+	token := c.Param("token")
+
+	share, err := h.db.loadShare(titleHash, token)
+	if err != nil {
+		return err
+	}
+
+	md := &pageData{titleHash: titleHash}
+	err = h.db.with(c).loadBare(md)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "page not found")
+	}
+
+	// Other pages are not shared.
+	html := h.db.renderMarkdown(md, func(title string) (string, linkState) {
+		return "", linkNone
+	})
+	prefix := "/page/" + titleHash + "/file/"
+	if !share.Files {
+		prefix += diagramPrefix
+	}
+	html = bytes.Replace(html, []byte(`="`+prefix), []byte(`="/share/`+titleHash+"/"+token+strings.TrimPrefix(prefix, "/page/"+titleHash)), -1)
+
+	return c.Render(http.StatusOK, "shared.html", map[string]interface{}{
+		"Title":        md.title,
+		"Body":         template.HTML(html),
+		"LastModified": md.lastUpdate,
+		"Author":       md.author,
+		"Expires":      share.Expires,
+	})
+}
+
+func (h *handler) sharedFileHandler(c echo.Context) (err error) {
+	titleHash := c.Param("titleHash")
+
+	share, err := h.db.loadShare(titleHash, c.Param("token"))
+	if err != nil {
+		return err
+	}
+	// Diagrams are part of the page.
+	filename := c.Param("filename")
+	if !share.Files && !strings.HasPrefix(filename, diagramPrefix) {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+
+	fileData := &fileData{
+		filename:  filename,
+		titleHash: titleHash,
+	}
+	err = h.db.with(c).loadBare(fileData)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound)
+	}
+	return c.Blob(http.StatusOK, fileData.contentType, fileData.filebyte)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/juntaki/transparent"
+	"github.com/labstack/echo"
+)
+
+// Writes are synchronous by default (DURABILITY=sync), saveBare returns after
+// the object is written to S3, so that handlers can report failures.
+// DURABILITY=async leaves writes to the stack, which is faster but the
+// failure is lost. In both modes, transient failures are retried with backoff.
+// Handlers call storage by h.db.with(c), so that retries and failures are
+// logged with the request ID.
+
+var (
+	storageAttempts = 4
+	storageBackoff  = 200 * time.Millisecond // doubled on each retry
+)
+
+// parseDurability returns true for async writes.
+func parseDurability(str string) (bool, error) {
+	switch str {
+	case "", "sync":
+		return false, nil
+	case "async":
+		return true, nil
+	}
+	return false, errors.New("unknown durability: " + str)
+}
+
+// isTransient returns true if the request may succeed by retry.
+func isTransient(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		return reqErr.StatusCode() >= 500 || reqErr.StatusCode() == 429
+	}
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case "RequestError", "RequestTimeout", "SlowDown", "Throttling", "InternalError", "ServiceUnavailable":
+			return true
+		}
+	}
+	return false
+}
+
+// storageCall is storage operations logged by log, such as the logger of a request.
+type storageCall struct {
+	*Wikidata
+	log *log.Entry
+}
+
+// with returns storage operations for the request.
+func (w *Wikidata) with(c echo.Context) *storageCall {
+	return &storageCall{Wikidata: w, log: logger(c)}
+}
+
+// background returns storage operations out of requests, such as jobs.
+func (w *Wikidata) background() *storageCall {
+	return &storageCall{Wikidata: w, log: log.NewEntry(log.StandardLogger())}
+}
+
+// retry calls op until it succeeds, fails permanently or reaches storageAttempts.
+func (s *storageCall) retry(op func() error) error {
+	wait := storageBackoff
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || !isTransient(err) || attempt >= storageAttempts {
+			if err != nil && attempt > 1 {
+				s.log.WithFields(log.Fields{"attempt": attempt, "error": err.Error()}).Error("storage failed")
+			}
+			return err
+		}
+		s.log.WithFields(log.Fields{"attempt": attempt, "error": err.Error()}).Warn("storage failed, retry")
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// write calls op for the stack, and waits until it's written unless async.
+func (s *storageCall) write(stack *transparent.Stack, op func() error) error {
+	return s.retry(func() error {
+		err := op()
+		if err != nil || s.asyncWrites {
+			return err
+		}
+		return stack.Sync()
+	})
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+)
+
+// Pages are tagged by #tag in the body, or tags of front-matter.
+// Tags are case-insensitive.
+
+// Tag follows a space, so that anchors like [intro](#intro) are not tags.
+var hashtagRegexp = regexp.MustCompile(`(^|\s)#(\pL[\pL\pN_\-]*)`)
+
+// parseTags returns sorted tags in the body and the front-matter.
+func parseTags(body string) []string {
+	found := make(map[string]bool)
+	meta, body, _ := parseFrontMatter(body)
+	for _, tag := range meta.Tags {
+		found[strings.ToLower(tag)] = true
+	}
+	mapOutsideCode(body, func(text string) string {
+		for _, m := range hashtagRegexp.FindAllStringSubmatch(text, -1) {
+			found[strings.ToLower(m[2])] = true
+		}
+		return text
+	})
+
+	var tags []string
+	for tag := range found {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// renderTags marks #tag in markdown as inline HTML.
+func renderTags(body string) string {
+	return mapOutsideCode(body, func(text string) string {
+		return hashtagRegexp.ReplaceAllString(text, `$1<span class="tag">#$2</span>`)
+	})
+}
+
+func (w *Wikidata) loadTagIndex() (*tagIndexData, error) {
+	index := &tagIndexData{}
+	err := w.loadBare(index)
+	if err == nil {
+		return index, nil
+	}
+
+	// First access or broken index, scan pages to recover it.
+	log.WithField("error", err.Error()).Warn("tag index not found, rebuild")
+	index.Pages = make(reverseIndex)
+	err = w.forEachPage(func(markdown *pageData) {
+		index.Pages.set(markdown.titleHash, parseTags(markdown.body))
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = w.saveBare(index)
+	if err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// setTags updates the tag index with the new body of the page.
+func (w *Wikidata) setTags(titleHash, body string) error {
+	w.indexLock.Lock()
+	defer w.indexLock.Unlock()
+
+	index, err := w.loadTagIndex()
+	if err != nil {
+		return err
+	}
+	w.indexUpdated(titleHash)
+	if index.Pages.set(titleHash, parseTags(body)) {
+		return w.saveBare(index)
+	}
+	return nil
+}
+
+type tagCount struct {
+	Name  string
+	Count int
+	Size  int // 1 to 5, for tag cloud
+}
+
+func (h *handler) tagCloudHandler(c echo.Context) (err error) {
+	h.db.indexLock.Lock()
+	index, err := h.db.loadTagIndex()
+	h.db.indexLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	var tags []*tagCount
+	min, max := 0, 0
+	for name, pages := range index.Pages {
+		count := len(pages)
+		if min == 0 || count < min {
+			min = count
+		}
+		if count > max {
+			max = count
+		}
+		tags = append(tags, &tagCount{Name: name, Count: count})
+	}
+	for _, tag := range tags {
+		tag.Size = 1
+		if max > min {
+			tag.Size += 4 * (tag.Count - min) / (max - min)
+		}
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i].Name < tags[j].Name
+	})
+
+	return c.Render(http.StatusOK, "tags.html", map[string]interface{}{
+		"Tags": tags,
+	})
+}
+
+func (h *handler) tagHandler(c echo.Context) (err error) {
+	name := strings.ToLower(c.Param("name"))
+
+	h.db.indexLock.Lock()
+	index, err := h.db.loadTagIndex()
+	h.db.indexLock.Unlock()
+	if err != nil {
+		return err
+	}
+	titles, err := h.db.titles()
+	if err != nil {
+		return err
+	}
+
+	var pages []*pageNode
+	for titleHash := range index.Pages[name] {
+		title, ok := titles[titleHash]
+		if !ok {
+			continue
+		}
+		pages = append(pages, &pageNode{
+			Name:      title,
+			Title:     title,
+			TitleHash: titleHash,
+			Exists:    true,
+		})
+	}
+	sort.Slice(pages, func(i, j int) bool {
+		return pages[i].Title < pages[j].Title
+	})
+
+	return c.Render(http.StatusOK, "tag.html", map[string]interface{}{
+		"Tag":   name,
+		"Pages": pages,
+	})
+}
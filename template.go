@@ -0,0 +1,72 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Pages titled "Template:<name>" are templates of new pages.
+// A template is the default for new pages whose title starts with <name>,
+// e.g. "Template:ADR" is used for "ADR-001 Use S3".
+// Variables in the template body are replaced when the page is created.
+//   {{title}}   Title of the new page
+//   {{date}}    2006-01-02
+//   {{time}}    15:04
+//   {{author}}  User who creates the page
+
+const templatePrefix = "Template:"
+
+type pageTemplate struct {
+	Title     string
+	TitleHash string
+	Name      string // Title without prefix
+}
+
+func isTemplate(title string) bool {
+	return strings.HasPrefix(title, templatePrefix)
+}
+
+// listTemplates returns template pages sorted by name.
+func (w *Wikidata) listTemplates() ([]*pageTemplate, error) {
+	titles, err := w.titles()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*pageTemplate
+	for titleHash, title := range titles {
+		if isTemplate(title) {
+			result = append(result, &pageTemplate{
+				Title:     title,
+				TitleHash: titleHash,
+				Name:      strings.TrimPrefix(title, templatePrefix),
+			})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+// defaultTemplate returns the template of the longest name which title starts with.
+func defaultTemplate(templates []*pageTemplate, title string) *pageTemplate {
+	var found *pageTemplate
+	for _, t := range templates {
+		if t.Name != "" && strings.HasPrefix(title, t.Name) &&
+			(found == nil || len(t.Name) > len(found.Name)) {
+			found = t
+		}
+	}
+	return found
+}
+
+func expandTemplate(body, title, author string, now time.Time) string {
+	return strings.NewReplacer(
+		"{{title}}", title,
+		"{{date}}", now.Format("2006-01-02"),
+		"{{time}}", now.Format("15:04"),
+		"{{author}}", author,
+	).Replace(body)
+}
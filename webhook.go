@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+)
+
+// Webhooks registered by admins are called on wiki events, with JSON payload.
+// The payload is signed by the secret of webhook, as the header
+//   X-BucketWiki-Signature: sha256=<hex of HMAC-SHA256(secret, body)>
+// Failed deliveries are retried with exponential backoff, by webhook-retry job.
+// Pending retries are saved in the delivery log, and loaded again at startup.
+
+const (
+	eventPageCreated   = "page.created"
+	eventPageUpdated   = "page.updated"
+	eventPageDeleted   = "page.deleted"
+	eventPagePublished = "page.published"
+	eventFileUploaded  = "file.uploaded"
+)
+
+var webhookEvents = []string{
+	eventPageCreated,
+	eventPageUpdated,
+	eventPageDeleted,
+	eventPagePublished,
+	eventFileUploaded,
+}
+
+// changeEvents maps the action of changelog to the event.
+var changeEvents = map[string]string{
+	changeCreate: eventPageCreated,
+	changeEdit:   eventPageUpdated,
+	changeDelete: eventPageDeleted,
+	changePublic: eventPagePublished,
+}
+
+const (
+	webhookAttempts   = 5
+	maxDeliveryLog    = 50
+	webhookTimeout    = 10 * time.Second
+	webhookSignHeader = "X-BucketWiki-Signature"
+)
+
+// webhookBackoff is the wait before the first retry, doubled on each retry.
+var webhookBackoff = 5 * time.Second
+
+// pendingDelivery is the delivery waiting for retry.
+type pendingDelivery struct {
+	Event   *webhookEvent `json:"event"`
+	Attempt int           `json:"attempt"` // Attempts so far
+	Next    time.Time     `json:"next"`
+
+	hook *webhook
+	body []byte
+}
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+type webhookEvent struct {
+	ID        string    `json:"id"`
+	Event     string    `json:"event"`
+	Time      time.Time `json:"time"`
+	User      string    `json:"user"`
+	Title     string    `json:"title"`
+	TitleHash string    `json:"titleHash"`
+	URL       string    `json:"url"`
+	Summary   string    `json:"summary,omitempty"`
+	Filename  string    `json:"filename,omitempty"`
+}
+
+func (hook *webhook) accepts(event string) bool {
+	for _, e := range hook.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *Wikidata) loadWebhooks() *webhookData {
+	hooks := &webhookData{}
+	err := w.loadBare(hooks)
+	if err != nil {
+		// No webhooks yet
+		hooks.Hooks = nil
+	}
+	return hooks
+}
+
+// dispatchWebhooks delivers the event to webhooks in background.
+func (w *Wikidata) dispatchWebhooks(event *webhookEvent) {
+	w.webhookLock.Lock()
+	hooks := w.loadWebhooks().Hooks
+	w.webhookLock.Unlock()
+
+	for _, hook := range hooks {
+		if !hook.accepts(event.Event) {
+			continue
+		}
+		id, err := randomString()
+		if err != nil {
+			log.WithField("error", err.Error()).Error("dispatch webhook failed")
+			return
+		}
+		e := *event
+		e.ID = id[:16]
+		w.deliveries.Add(1)
+		go func(hook *webhook) {
+			defer w.deliveries.Done()
+			w.deliver(hook, &e)
+		}(hook)
+	}
+}
+
+// dispatchChange delivers the change of changelog as the event.
+func (w *Wikidata) dispatchChange(change *changeData) {
+	event, ok := changeEvents[change.Action]
+	if !ok {
+		return
+	}
+	w.dispatchWebhooks(&webhookEvent{
+		Event:     event,
+		Time:      change.Time,
+		User:      change.User,
+		Title:     change.Title,
+		TitleHash: change.TitleHash,
+		URL:       pageURL(w.config.URL, change),
+		Summary:   change.Summary,
+	})
+}
+
+// deliver posts the event. If it fails, it's queued for retry.
+func (w *Wikidata) deliver(hook *webhook, event *webhookEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.WithField("error", err.Error()).Error("webhook payload failed")
+		return
+	}
+	w.attemptDelivery(&pendingDelivery{hook: hook, Event: event, body: body})
+}
+
+func (w *Wikidata) attemptDelivery(p *pendingDelivery) {
+	p.Attempt++
+	d := &delivery{
+		ID:      p.Event.ID,
+		Event:   p.Event.Event,
+		Time:    time.Now(),
+		Attempt: p.Attempt,
+	}
+	var err error
+	d.Status, err = postWebhook(p.hook, p.Event, p.body)
+	d.Duration = time.Since(d.Time)
+	if err != nil {
+		d.Error = err.Error()
+	}
+	retry := err != nil && p.Attempt < webhookAttempts
+	if err != nil && !retry {
+		log.WithFields(log.Fields{"url": p.hook.URL, "delivery": p.Event.ID, "error": err.Error()}).Error("webhook delivery failed")
+	}
+	if retry {
+		p.Next = time.Now().Add(webhookBackoff << uint(p.Attempt-1))
+	}
+	w.logDelivery(p, d, retry)
+}
+
+// retryWebhooks attempts the deliveries which are due.
+func (w *Wikidata) retryWebhooks() error {
+	now := time.Now()
+	var due, rest []*pendingDelivery
+	w.webhookLock.Lock()
+	for _, p := range w.retries {
+		if p.Next.After(now) {
+			rest = append(rest, p)
+		} else {
+			due = append(due, p)
+		}
+	}
+	w.retries = rest
+	w.webhookLock.Unlock()
+
+	for _, p := range due {
+		w.attemptDelivery(p)
+	}
+	return nil
+}
+
+// loadRetries queues the pending retries saved in delivery logs.
+func (w *Wikidata) loadRetries() {
+	w.webhookLock.Lock()
+	defer w.webhookLock.Unlock()
+
+	for _, hook := range w.loadWebhooks().Hooks {
+		for _, p := range w.loadDeliveryLog(hook.ID).Pending {
+			body, err := json.Marshal(p.Event)
+			if err != nil {
+				log.WithField("error", err.Error()).Error("webhook payload failed")
+				continue
+			}
+			p.hook, p.body = hook, body
+			w.retries = append(w.retries, p)
+		}
+	}
+}
+
+func postWebhook(hook *webhook, event *webhookEvent, body []byte) (int, error) {
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-BucketWiki-Event", event.Event)
+	req.Header.Set("X-BucketWiki-Delivery", event.ID)
+	req.Header.Set(webhookSignHeader, webhookSignature(hook.Secret, body))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+func (w *Wikidata) loadDeliveryLog(hookID string) *deliveryLogData {
+	dl := &deliveryLogData{HookID: hookID}
+	err := w.loadBare(dl)
+	if err != nil {
+		dl.Deliveries = nil
+	}
+	return dl
+}
+
+// logDelivery saves the attempt of p, and queues p for retry if retry is true.
+func (w *Wikidata) logDelivery(p *pendingDelivery, d *delivery, retry bool) {
+	w.webhookLock.Lock()
+	defer w.webhookLock.Unlock()
+
+	dl := w.loadDeliveryLog(p.hook.ID)
+	dl.Deliveries = append([]*delivery{d}, dl.Deliveries...)
+	if len(dl.Deliveries) > maxDeliveryLog {
+		dl.Deliveries = dl.Deliveries[:maxDeliveryLog]
+	}
+	var pending []*pendingDelivery
+	for _, q := range dl.Pending {
+		if q.Event.ID != p.Event.ID {
+			pending = append(pending, q)
+		}
+	}
+	if retry {
+		pending = append(pending, p)
+		w.retries = append(w.retries, p)
+	}
+	dl.Pending = pending
+	err := w.saveBare(dl)
+	if err != nil {
+		log.WithFields(log.Fields{"hook": p.hook.ID, "error": err.Error()}).Error("save delivery log failed")
+	}
+}
+
+func (h *handler) webhooksHandler(c echo.Context) (err error) {
+	h.db.webhookLock.Lock()
+	hooks := h.db.loadWebhooks().Hooks
+	h.db.webhookLock.Unlock()
+
+	return c.Render(http.StatusOK, "webhooks.html", map[string]interface{}{
+		"Hooks":  hooks,
+		"Events": webhookEvents,
+	})
+}
+
+func (h *handler) createWebhookHandler(c echo.Context) (err error) {
+	u, err := url.Parse(c.FormValue("url"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid webhook URL")
+	}
+	form, err := c.FormParams()
+	if err != nil {
+		return err
+	}
+	var events []string
+	for _, event := range form["events"] {
+		known := false
+		for _, e := range webhookEvents {
+			known = known || e == event
+		}
+		if !known {
+			return echo.NewHTTPError(http.StatusBadRequest, "unknown event: "+event)
+		}
+		events = append(events, event)
+	}
+	if len(events) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "no events")
+	}
+
+	id, err := randomString()
+	if err != nil {
+		return err
+	}
+	secret, err := randomString()
+	if err != nil {
+		return err
+	}
+	sess := c.Get("session").(*sessionData)
+
+	h.db.webhookLock.Lock()
+	defer h.db.webhookLock.Unlock()
+	hooks := h.db.loadWebhooks()
+	hooks.Hooks = append(hooks.Hooks, &webhook{
+		ID:      id[:16],
+		URL:     u.String(),
+		Secret:  secret,
+		Events:  events,
+		Creator: sess.User,
+		Created: time.Now(),
+	})
+	err = h.db.with(c).saveBare(hooks)
+	if err != nil {
+		return err
+	}
+	h.audit(c, &auditData{Action: auditWebhookCreate, Target: u.String(), Detail: strings.Join(events, ","), Success: true})
+	return c.Redirect(http.StatusFound, "/admin/webhooks")
+}
+
+func (h *handler) deleteWebhookHandler(c echo.Context) (err error) {
+	id := c.Param("id")
+
+	h.db.webhookLock.Lock()
+	defer h.db.webhookLock.Unlock()
+	hooks := h.db.loadWebhooks()
+	for i, hook := range hooks.Hooks {
+		if hook.ID == id {
+			hooks.Hooks = append(hooks.Hooks[:i], hooks.Hooks[i+1:]...)
+			err = h.db.with(c).saveBare(hooks)
+			if err != nil {
+				return err
+			}
+			h.audit(c, &auditData{Action: auditWebhookDelete, Target: hook.URL, Success: true})
+			return c.Redirect(http.StatusFound, "/admin/webhooks")
+		}
+	}
+	return echo.NewHTTPError(http.StatusNotFound)
+}
+
+func (h *handler) deliveriesHandler(c echo.Context) (err error) {
+	id := c.Param("id")
+
+	h.db.webhookLock.Lock()
+	defer h.db.webhookLock.Unlock()
+	for _, hook := range h.db.loadWebhooks().Hooks {
+		if hook.ID == id {
+			return c.Render(http.StatusOK, "deliveries.html", map[string]interface{}{
+				"Hook":       hook,
+				"Deliveries": h.db.loadDeliveryLog(id).Deliveries,
+			})
+		}
+	}
+	return echo.NewHTTPError(http.StatusNotFound)
+}
+
+// fileURL returns URL of the attachment, base is URL of the wiki.
+func fileURL(base, titleHash, filename string) string {
+	return base + "/page/" + titleHash + "/file/" + url.PathEscape(filename)
+}
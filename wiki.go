@@ -1,21 +1,20 @@
 package main
 
 import (
-	"errors"
+	"flag"
 	"html/template"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
-	"regexp"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
 	"github.com/markbates/goth"
 	"github.com/markbates/goth/providers/twitter"
-
-	"github.com/microcosm-cc/bluemonday"
-	"github.com/russross/blackfriday"
+	"github.com/tylerb/graceful"
 )
 
 type handler struct {
@@ -31,47 +30,94 @@ func (t *Template) Render(w io.Writer, name string, data interface{}, c echo.Con
 }
 
 func main() {
-	if os.Getenv("AWS_BUCKET_NAME") == "" ||
-		os.Getenv("AWS_BUCKET_REGION") == "" ||
-		os.Getenv("AWS_ACCESS_KEY_ID") == "" ||
-		os.Getenv("AWS_SECRET_ACCESS_KEY") == "" ||
-		os.Getenv("WIKI_SECRET") == "" {
-		log.Println("Error at environment variable")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "config":
+			os.Exit(configCommand(os.Args[2:]))
+		case "setup":
+			os.Exit(setupCommand(os.Args[2:]))
+		}
+	}
+
+	fs := flag.NewFlagSet("bucketwiki", flag.ExitOnError)
+	cfg, err := loadConfig(fs, os.Args[1:], os.LookupEnv)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	err = setupLogging(cfg.Log.Format, cfg.Log.Level, cfg.Debug)
+	if err != nil {
+		log.Println(err)
 		os.Exit(1)
 	}
 
 	s3 := &Wikidata{
-		bucket: os.Getenv("AWS_BUCKET_NAME"),
-		region: os.Getenv("AWS_BUCKET_REGION"),
+		bucket: cfg.Storage.Bucket,
+		region: cfg.Storage.Region,
+		config: cfg,
 	}
-	err := s3.connect()
+	// Already validated by loadConfig
+	s3.cacheConfig, _ = parseCacheConfig(cfg.Cache.Sizes, cfg.Cache.NegativeTTL)
+	s3.asyncWrites, _ = parseDurability(cfg.Storage.Durability)
+	err = s3.connect()
 	if err != nil {
 		log.Println(err)
 		os.Exit(1)
 	}
+	s3.warnSetup()
+
+	inv, err := newInvalidator(s3, cfg.Cache.Invalidation)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	if inv != nil {
+		err = s3.setInvalidator(inv)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+	}
 
 	e := echo.New()
-	e.Debug = true
+	e.Debug = cfg.Debug
+	e.HTTPErrorHandler = errorHandler(e)
 	t := &Template{
 		templates: template.Must(template.ParseGlob("style/*.html")),
 	}
 	e.Renderer = t
+	s3.templates = t.templates
+
+	s3.markdown, _ = parseRenderOptions(cfg.Markdown.Extensions)
+	plantUMLURL = cfg.Markdown.PlantUMLURL
+
+	s3.publisher, err = newPublisher(s3, cfg.Publish.Target, cfg.Publish.Dir, cfg.Publish.URL)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+
+	s3.notifiers = newNotifiers(cfg)
 
 	h := handler{db: s3}
 
-	goth.UseProviders(
-		twitter.New(
-			os.Getenv("TWITTER_KEY"),
-			os.Getenv("TWITTER_SECRET"),
-			os.Getenv("URL")+"/auth/callback?provider=twitter",
-		),
-	)
+	if cfg.Auth.TwitterKey != "" {
+		goth.UseProviders(
+			twitter.New(
+				cfg.Auth.TwitterKey,
+				cfg.Auth.TwitterSecret,
+				cfg.URL+"/auth/callback?provider=twitter",
+			),
+		)
+	}
 
-	e.Use(middleware.Logger())
+	e.Use(requestIDMiddleware())
+	e.Use(accessLogMiddleware())
+	e.Use(metricsMiddleware())
 	e.Use(middleware.Recover())
-	e.GET("/err", func(c echo.Context) (err error) {
-		return errors.New("some error")
-	})
+	addDebugRoutes(e)
+	e.GET("/healthz", h.healthzHandler)
+	e.GET("/readyz", h.readyzHandler)
 	e.GET("/login", h.loginPageHandler)
 	e.POST("/login", h.loginHandler)
 	e.GET("/signup", h.signupPageHandler)
@@ -79,10 +125,18 @@ func main() {
 
 	e.GET("/auth/callback", h.authCallbackHandler)
 	e.GET("/auth", h.authHandler)
+	e.GET("/share/:titleHash/:token", h.sharedPageHandler)
+	e.GET("/share/:titleHash/:token/file/:filename", h.sharedFileHandler)
+	e.GET("/feed/:format", h.feedHandler)
+	e.GET("/metrics", h.metricsHandler)
 	e.File("/500", "style/500.html")
 	e.File("/404", "style/404.html")
 	e.File("/layout.css", "style/layout.css")
+	e.GET("/highlight.css", highlightCSSHandler)
 	e.File("/favicon.ico", "style/favicon.ico")
+	if _, ok := s3.publisher.(*serverPublisher); ok {
+		e.GET("/public/*", h.publicHandler)
+	}
 
 	auth := e.Group("")
 	auth.Use(h.authMiddleware())
@@ -100,28 +154,85 @@ func main() {
 	auth.POST("/page/:titleHash/acl", h.aclHandler)
 	auth.PUT("/page/:titleHash", h.putPageHandler)
 	auth.DELETE("/page/:titleHash", h.deletePageHandler)
-
-	port := ":" + os.Getenv("PORT")
-	if port == ":" {
-		port = ":8080"
+	auth.GET("/page/:titleHash/share", h.shareListHandler)
+	auth.POST("/page/:titleHash/share", h.createShareHandler)
+	auth.POST("/page/:titleHash/share/:id/revoke", h.revokeShareHandler)
+	auth.POST("/publish", h.publishHandler)
+	auth.GET("/tag", h.tagCloudHandler)
+	auth.GET("/tag/:name", h.tagHandler)
+	auth.GET("/pages", h.pagesHandler)
+	auth.GET("/recent", h.recentHandler)
+	auth.POST("/feed/token", h.createFeedTokenHandler)
+	auth.POST("/feed/token/:id/revoke", h.revokeFeedTokenHandler)
+	auth.POST("/page/:titleHash/watch", h.watchHandler)
+	auth.GET("/notifications", h.notificationsHandler)
+	auth.POST("/notifications", h.notificationSettingsHandler)
+	auth.POST("/notifications/namespace", h.watchNamespaceHandler)
+	auth.POST("/notifications/read", h.readNotificationsHandler)
+	auth.GET("/page/:titleHash/meta", h.pageMetaHandler)
+
+	admin := auth.Group("/admin")
+	admin.Use(h.adminMiddleware())
+	admin.GET("/webhooks", h.webhooksHandler)
+	admin.POST("/webhooks", h.createWebhookHandler)
+	admin.GET("/webhooks/:id", h.deliveriesHandler)
+	admin.POST("/webhooks/:id/delete", h.deleteWebhookHandler)
+	admin.GET("/cache", h.cacheHandler)
+	admin.POST("/cache/flush", h.flushCacheHandler)
+	admin.GET("/audit", h.auditHandler)
+	admin.GET("/jobs", h.jobsHandler)
+
+	s3.startJobs()
+	// Stops on SIGTERM or SIGINT, after requests in progress finish.
+	e.Server.Addr = cfg.Listen
+	srv := &graceful.Server{Server: e.Server, Timeout: cfg.ShutdownTimeout}
+	err = srv.ListenAndServe()
+	if err != nil {
+		log.Println(err)
+	}
+	log.Info("shutting down")
+	s3.shutdown()
+	if err != nil {
+		os.Exit(1)
 	}
-	e.Logger.Fatal(e.Start(port))
 }
 
 func (h *handler) aclHandler(c echo.Context) (err error) {
 	titleHash := c.Param("titleHash")
 	acl := c.FormValue("acl")
+	var public bool
+	var action string
 	switch acl {
 	case "public":
-		err = h.db.setACL(titleHash, true)
+		public, action = true, changePublic
 	case "private":
-		err = h.db.setACL(titleHash, false)
+		public, action = false, changePrivate
 	default:
-		err = echo.NewHTTPError(http.StatusBadRequest, "unknown ACL")
+		return echo.NewHTTPError(http.StatusBadRequest, "unknown ACL")
+	}
+
+	md := &pageData{titleHash: titleHash}
+	err = h.db.with(c).loadBare(md)
+	if err != nil {
+		return err
 	}
+	// Nothing is changed, so that watchers and webhooks don't get the event.
+	if md.public == public {
+		return c.Redirect(http.StatusFound, "/page/"+titleHash)
+	}
+	err = h.db.setACL(titleHash, public)
 	if err != nil {
 		return err
 	}
+
+	sess := c.Get("session").(*sessionData)
+	h.db.recordChange(&changeData{
+		User:      sess.User,
+		Action:    action,
+		TitleHash: titleHash,
+		Title:     md.title,
+	})
+	h.audit(c, &auditData{Action: auditACL, Target: md.title, Detail: acl, Success: true})
 	return c.Redirect(http.StatusFound, "/page/"+titleHash)
 }
 
@@ -134,9 +245,9 @@ func (h *handler) fileHandler(c echo.Context) (err error) {
 		titleHash: titleHash,
 	}
 
-	err = h.db.loadBare(fileData)
+	err = h.db.with(c).loadBare(fileData)
 	if err != nil {
-		log.Println(err)
+		logger(c).WithField("error", err.Error()).Warn("load file failed")
 		return nil
 	}
 	return c.Blob(http.StatusOK, fileData.contentType, fileData.filebyte)
@@ -163,65 +274,42 @@ func (h *handler) pageHandler(c echo.Context) (err error) {
 		versionId: versionId,
 	}
 
-	err = h.db.loadBare(md)
+	err = h.db.with(c).loadBare(md)
 	if err != nil {
 		// If no object found, title cannot get from metadata, so it must be passed via query.
 		if versionId == "" {
 			title := c.QueryParam("title")
-			return c.Redirect(http.StatusFound, "/page/"+titleHash+"/edit?title="+title)
+			return c.Redirect(http.StatusFound, "/page/"+titleHash+"/edit?title="+url.QueryEscape(title))
 		}
 		return c.Redirect(http.StatusFound, "/404")
 	}
 
-	sess := c.Get("session").(*sessionData)
-
-	sess.BreadCrumb = h.db.updateBreadcrumb(sess.BreadCrumb, md.title)
-
-	err = h.setSession(c, sess)
+	titles, err := h.db.titles()
 	if err != nil {
-		return err
+		logger(c).WithField("error", err.Error()).Warn("load titles failed")
 	}
+	tree, node := h.db.pageTree(titles, md.title)
+	meta, _, err := parseFrontMatter(md.body)
+	if err != nil {
+		logger(c).WithField("error", err.Error()).Warn("parse front-matter failed")
+	}
+	sess := c.Get("session").(*sessionData)
 
 	return c.Render(http.StatusOK, "view.html", map[string]interface{}{
 		"Title":        md.title,
+		"Name":         node.Name,
 		"TitleHash":    titleHash,
 		"Body":         template.HTML(h.db.renderHTML(md)),
-		"Breadcrumb":   sess.BreadCrumb,
+		"Breadcrumb":   h.db.breadcrumb(md.title),
+		"Tree":         tree,
+		"Subpages":     node.Children,
+		"Tags":         parseTags(md.body),
+		"Meta":         meta,
+		"Overdue":      meta.reviewOverdue(time.Now()),
+		"Watching":     h.db.watcher(sess.User).Pages[titleHash],
 		"Public":       md.public,
 		"PublicURL":    h.db.publicURL(titleHash),
 		"LastModified": md.lastUpdate,
 		"Author":       md.author,
 	})
 }
-
-func (s3 *Wikidata) updateBreadcrumb(list []([]string), title string) []([]string) {
-	var tmpList []([]string)
-
-	for _, l := range list {
-		if l[0] != title {
-			tmpList = append(tmpList, l)
-		}
-	}
-	tmpList = append(tmpList, []string{title, s3.titleHash(title)})
-
-	maxSize := 5
-	// Cut down the size
-	if len(tmpList) > maxSize {
-		tmpList = tmpList[1 : maxSize+1]
-	}
-	return tmpList
-}
-
-func (s3 *Wikidata) renderHTML(md *pageData) []byte {
-	rep := regexp.MustCompile(`\[\[.*?\]\]`)
-
-	str := md.body
-	str = rep.ReplaceAllStringFunc(str, func(a string) string {
-		title := a[2 : len(a)-2]
-		return "[" + title + "](/page/" + s3.titleHash(title) + "?title=" + title + ")"
-	})
-
-	unsafe := blackfriday.MarkdownCommon([]byte(str))
-	html := bluemonday.UGCPolicy().SanitizeBytes(unsafe)
-	return html
-}
@@ -1,13 +1,33 @@
 package main
 
 import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"html/template"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
 	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	ts3 "github.com/juntaki/transparent/s3"
 	"github.com/k0kubun/pp"
 	"github.com/labstack/echo"
 )
@@ -21,6 +41,7 @@ func init() {
 		bucket:     "testbucket",
 		region:     "testregion",
 		wikiSecret: "testSecret",
+		config:     defaultConfig(),
 	}
 	wikidata.initializeCache()
 	h = handler{db: wikidata}
@@ -30,6 +51,9 @@ func init() {
 		templates: template.Must(template.ParseGlob("style/*.html")),
 	}
 	e.Renderer = t
+	wikidata.templates = t.templates
+	wikidata.markdown, _ = parseRenderOptions("")
+	wikidata.publisher, _ = newPublisher(wikidata, "s3", "", "")
 }
 
 func TestLogin(t *testing.T) {
@@ -147,3 +171,1243 @@ func TestPageHandler(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestRenderPublicHTML(t *testing.T) {
+	w := h.db
+	index := &publicIndexData{Pages: map[string]*publicPage{
+		w.titleHash("Public"): {Title: "Public", TitleHash: w.titleHash("Public")},
+	}}
+	md := &pageData{body: "[[Public]] [[Private]]"}
+
+	html := string(w.renderPublicHTML(md, index))
+	if !strings.Contains(html, `<a href="`+w.publicURL(w.titleHash("Public"))+`"`) {
+		t.Error("link to public page not found", html)
+	}
+	if strings.Contains(html, w.titleHash("Private")) {
+		t.Error("link to private page found", html)
+	}
+
+	// Only links to public pages are rewritten, code is kept as-is.
+	public, private := "/page/"+w.titleHash("Public"), "/page/"+w.titleHash("Private")
+	md = &pageData{body: "![img](" + public + "/file/a.png) [file](" + private + "/file/b.txt) [page](" + public + "#sec)\n\n`" + public + "/file/a.png`"}
+	html = string(w.renderPublicHTML(md, index))
+	base := w.publisher.baseURL()
+	for _, s := range []string{
+		`src="` + base + public + `/file/a.png"`,
+		`href="` + private + `/file/b.txt"`,
+		`href="` + w.publicURL(w.titleHash("Public")) + `#sec"`,
+		`<code>` + public + `/file/a.png</code>`,
+	} {
+		if !strings.Contains(html, s) {
+			t.Error("unexpected public link", s, html)
+		}
+	}
+
+	sitemap, err := w.sitemap(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(sitemap), "<loc>"+w.publicURL(w.titleHash("Public"))+"</loc>") {
+		t.Error("sitemap doesn't have public page", string(sitemap))
+	}
+}
+
+func TestDirPublisher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucketwiki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, err = newPublisher(h.db, "dir", dir, "")
+	if err == nil {
+		t.Error("dir target without URL should be error")
+	}
+	p, err := newPublisher(h.db, "dir", dir, "http://example.com/wiki/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.baseURL() != "http://example.com/wiki" {
+		t.Error("unexpected base URL", p.baseURL())
+	}
+	err = p.put("page/hash/index.html", []byte("test"), "text/html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadFile(filepath.Join(dir, "page", "hash", "index.html"))
+	if err != nil || string(body) != "test" {
+		t.Error("file is not written", err)
+	}
+	err = p.remove("page/hash/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.remove("page/hash/index.html")
+	if err != nil {
+		t.Error("removing removed file should not fail", err)
+	}
+}
+
+func TestShareToken(t *testing.T) {
+	w := h.db
+	share := &shareData{
+		ID:        "id",
+		TitleHash: "titleHash",
+		Expires:   time.Now().Add(time.Hour),
+	}
+	token := w.shareToken(share)
+
+	_, err := w.loadShare("otherHash", token)
+	if err == nil {
+		t.Error("token for other page should be rejected")
+	}
+	_, err = w.loadShare("titleHash", "id.invalid")
+	if err == nil {
+		t.Error("invalid signature should be rejected")
+	}
+	if share.expired(time.Now()) {
+		t.Error("share should not be expired")
+	}
+	if !share.expired(time.Now().Add(2 * time.Hour)) {
+		t.Error("share should be expired")
+	}
+}
+
+func TestWikiLink(t *testing.T) {
+	tests := []struct {
+		in   string
+		link wikiLink
+	}{
+		{"Title", wikiLink{title: "Title", label: "Title"}},
+		{"Title|label", wikiLink{title: "Title", label: "label"}},
+		{"Title#Section", wikiLink{title: "Title", section: "Section", label: "Title#Section"}},
+		{"A & B?#Sec|x", wikiLink{title: "A & B?", section: "Sec", label: "x"}},
+	}
+	for _, tt := range tests {
+		if link := parseWikiLink(tt.in); link != tt.link {
+			t.Errorf("parseWikiLink(%q) = %#v, want %#v", tt.in, link, tt.link)
+		}
+	}
+
+	w := h.db
+	w.setPageExists(w.titleHash("Home"), true)
+	html := string(w.renderHTML(&pageData{body: "[[Home#Getting Started|home]] [[New & Page?]]"}))
+	if !strings.Contains(html, `href="/page/`+w.titleHash("Home")+`?title=Home#getting-started"`) {
+		t.Error("link with section not found", html)
+	}
+	if !strings.Contains(html, `?title=New+%26+Page%3F" class="wikilink-new"`) {
+		t.Error("red link not found", html)
+	}
+
+	// Links in code are kept as-is.
+	html = string(w.renderHTML(&pageData{body: "```\n[[X]] [[_TOC_]]\n```\n\n`[[X]]`\n"}))
+	if strings.Contains(html, w.titleHash("X")) || strings.Contains(html, `class="toc"`) || !strings.Contains(html, "<code>[[X]]</code>") {
+		t.Error("link in code should not be rendered", html)
+	}
+}
+
+func TestRenderExtensions(t *testing.T) {
+	body := `[[_TOC_]]
+
+# First
+
+## Second
+
+Text[^1]
+
+- [ ] todo
+- [x] done
+
+~~del~~
+
+| a | b |
+|---|---|
+| 1 | 2 |
+
+[^1]: note
+`
+	html := string(h.db.renderHTML(&pageData{body: body}))
+	for _, s := range []string{
+		`<div class="toc"><ul><li><a href="#first">First</a><ul><li><a href="#second">Second</a></li></ul></li></ul></div>`,
+		`<h1 id="first">First</h1>`,
+		`<sup class="footnote-ref" id="fnref:1">`,
+		`<li id="fn:1">`,
+		`<li class="task-list-item"><input type="checkbox" disabled=""> todo`,
+		`<input type="checkbox" checked="" disabled=""> done`,
+		`<del>del</del>`,
+		`<table>`,
+	} {
+		if !strings.Contains(html, s) {
+			t.Errorf("%q not found in %s", s, html)
+		}
+	}
+
+	opts, err := parseRenderOptions("none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &Wikidata{markdown: opts}
+	html = string(w.renderMarkdown(&pageData{body: body}, func(string) (string, linkState) { return "", linkNone }))
+	if strings.Contains(html, "toc") || strings.Contains(html, "<del>") || strings.Contains(html, "<input") {
+		t.Error("extension should be disabled", html)
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	body := "``` {.go .linenos hl=2}\nfunc main() { // comment\n\treturn \"str\"\n}\n```\n"
+	html := string(h.db.renderHTML(&pageData{body: body}))
+	for _, s := range []string{
+		`<pre class="hl-chroma">`,
+		`<span class="hl-ln">1</span>`,
+		`<span class="hl-kd">func</span>`,
+		`<span class="hl-line hl-hl"><span class="hl-ln">2</span>`,
+		`<span class="hl-s">&#34;str&#34;</span>`,
+	} {
+		if !strings.Contains(html, s) {
+			t.Errorf("%q not found in %s", s, html)
+		}
+	}
+
+	html = string(h.db.renderHTML(&pageData{body: "```unknown\n<script>\n```\n"}))
+	if strings.Contains(html, "<script>") || !strings.Contains(html, "&lt;script&gt;") {
+		t.Error("code should be escaped", html)
+	}
+	if !strings.Contains(string(highlightCSS), ".hl-chroma .hl-k {") {
+		t.Error("unexpected css", string(highlightCSS))
+	}
+}
+
+func TestDiagramAndMath(t *testing.T) {
+	// HeadObject of mock always succeeds, so the diagram is cached.
+	body := "```dot\ndigraph { a -> b }\n```\n\nInline $x^2 + \\frac{1}{2}$ and `$code$`\n\n$$\n\\sqrt{a < b}\n$$\n"
+	html := string(h.db.renderHTML(&pageData{titleHash: "hash", body: body}))
+	for _, s := range []string{
+		`<img class="diagram" src="/page/hash/file/` + diagramFilename("dot", []byte("digraph { a -> b }\n")) + `"`,
+		`<math xmlns="http://www.w3.org/1998/Math/MathML"><mrow><msup><mi>x</mi><mn>2</mn></msup><mo>+</mo><mfrac><mrow><mn>1</mn></mrow><mrow><mn>2</mn></mrow></mfrac></mrow></math>`,
+		`<code>$code$</code>`,
+		`<math xmlns="http://www.w3.org/1998/Math/MathML" display="block"><mrow><msqrt><mrow><mi>a</mi><mo>&lt;</mo><mi>b</mi></mrow></msqrt></mrow></math>`,
+	} {
+		if !strings.Contains(html, s) {
+			t.Errorf("%q not found in %s", s, html)
+		}
+	}
+	if strings.Contains(html, "<p><math") {
+		t.Error("display math should not be in paragraph", html)
+	}
+
+	// New diagrams are rendered up to diagramMaxPerPage.
+	rendered := 0
+	diagramEngines["fake"] = func(context.Context, []byte) ([]byte, error) {
+		rendered++
+		return []byte("<svg></svg>"), nil
+	}
+	defer delete(diagramEngines, "fake")
+	body = ""
+	for i := 0; i <= diagramMaxPerPage; i++ {
+		source := fmt.Sprintln(i)
+		body += "```fake\n" + source + "```\n\n"
+		h.db.diagrams.set(ts3.BareKey{Bucket: h.db.bucket, Key: "page/hash/file/" + diagramFilename("fake", []byte(source))}, nil)
+	}
+	job := &diagramJob{}
+	html = string(h.db.render(&pageData{titleHash: "hash", body: body}, h.db.pageLink, nil, job))
+	if rendered != diagramMaxPerPage || job.rendered != diagramMaxPerPage || strings.Count(html, `class="diagram"`) != diagramMaxPerPage {
+		t.Error("diagrams should be limited", rendered, job.rendered, html)
+	}
+	h.db.renderHTML(&pageData{titleHash: "hash", body: body})
+	if rendered != diagramMaxPerPage {
+		t.Error("views should not render diagrams", rendered)
+	}
+
+	// Saved pages are rendered by the job.
+	err := h.db.queueDiagrams("hash")
+	if err != nil || !h.db.diagramQueue["hash"] {
+		t.Fatal("page is not queued", err)
+	}
+	err = h.db.renderQueuedDiagrams()
+	if err != nil || len(h.db.diagramQueue) != 0 {
+		t.Error("queue should be rendered", err, h.db.diagramQueue)
+	}
+
+	// PlantUML source is deflated in URL.
+	source := []byte(strings.Repeat("Bob -> Alice : hello\n", 100))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := plantUMLEncoding.DecodeString(strings.TrimPrefix(r.URL.Path, "/svg/"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		decoded, _ := ioutil.ReadAll(flate.NewReader(bytes.NewReader(data)))
+		if !bytes.Equal(decoded, source) {
+			http.Error(w, "unexpected source", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("<svg></svg>"))
+	}))
+	defer server.Close()
+	plantUMLURL = server.URL
+	defer func() { plantUMLURL = "" }()
+	svg, err := renderPlantUML(context.Background(), source)
+	if err != nil || string(svg) != "<svg></svg>" {
+		t.Error("plantuml failed", string(svg), err)
+	}
+
+	if m := texToMathML(strings.Repeat(`\sqrt `, 100)+"x", false); !strings.Contains(m, "too deep") {
+		t.Error("nested commands should be limited", m)
+	}
+	if m := texToMathML(strings.Repeat("x+", 3000), false); !strings.Contains(m, "too long") {
+		t.Error("long formula should be limited", m)
+	}
+	if m := texToMathML(strings.Repeat("x", 3000), false); !strings.Contains(m, "too large") {
+		t.Error("large formula should be limited", m)
+	}
+	if out, maths := extractMath("text\n\n    $x$ code\n\n$y$\n"); len(maths) != 1 || !strings.Contains(out, "    $x$ code") {
+		t.Error("indented code should be skipped", out, maths)
+	}
+}
+
+func TestPageTemplate(t *testing.T) {
+	templates := []*pageTemplate{
+		{Title: "Template:Meeting", Name: "Meeting"},
+		{Title: "Template:Meeting/Weekly", Name: "Meeting/Weekly"},
+		{Title: "Template:ADR", Name: "ADR"},
+	}
+	for title, expected := range map[string]string{
+		"Meeting/Weekly 10-19": "Meeting/Weekly",
+		"Meeting 10-19":        "Meeting",
+		"ADR-001":              "ADR",
+		"Runbook":              "",
+	} {
+		name := ""
+		if tmpl := defaultTemplate(templates, title); tmpl != nil {
+			name = tmpl.Name
+		}
+		if name != expected {
+			t.Errorf("template of %s expected %q, but got %q", title, expected, name)
+		}
+	}
+
+	now := time.Date(2016, 12, 1, 9, 30, 0, 0, time.UTC)
+	body := expandTemplate("# {{title}}\n{{date}} {{time}} by {{author}}\n", "ADR-001", "user", now)
+	if body != "# ADR-001\n2016-12-01 09:30 by user\n" {
+		t.Error("unexpected template body", body)
+	}
+}
+
+func TestInclude(t *testing.T) {
+	w := h.db
+	exists := func(string) (string, linkState) { return "/page", linkExists }
+	none := func(string) (string, linkState) { return "", linkNone }
+
+	// Body of every page is "test" in mock.
+	if body := w.expandIncludes("a\n{{include: Footer }}\n[[!Footer]]", exists, nil); body != "a\n\ntest\n\n\ntest\n" {
+		t.Errorf("unexpected include %q", body)
+	}
+	if body := w.expandIncludes("[[!Footer]]", none, nil); body != "Footer" {
+		t.Errorf("private page should not be included %q", body)
+	}
+	if body := w.expandIncludes("[[!Footer]]", exists, []string{w.titleHash("Footer")}); !strings.Contains(body, "Include loop") {
+		t.Errorf("loop should be detected %q", body)
+	}
+	if body := w.expandIncludes(strings.Repeat("[[!Footer]]", includeMaxExpansions+1), exists, nil); strings.Count(body, "test") != includeMaxExpansions || !strings.Contains(body, "Too many includes") {
+		t.Errorf("includes should be limited %q", body)
+	}
+	if body := w.expandIncludes("`[[!Footer]]`\n```\n{{include:Footer}}\n```\n", exists, nil); strings.Contains(body, "test") {
+		t.Errorf("includes in code should be kept %q", body)
+	}
+
+	index := make(reverseIndex)
+	index.set("b", []string{"a", "c"})
+	if !index.set("b", []string{"a"}) || index.set("b", []string{"a"}) {
+		t.Error("change should be detected")
+	}
+	if !index["a"]["b"] || index["c"] != nil {
+		t.Error("unexpected index", index)
+	}
+}
+
+func TestPageTree(t *testing.T) {
+	w := h.db
+	if path := titlePath("A/B/C"); len(path) != 3 || path[0] != "A" || path[1] != "A/B" || path[2] != "A/B/C" {
+		t.Error("unexpected path", path)
+	}
+
+	titles := map[string]string{}
+	for _, title := range []string{"Home", "Team/Meeting/2016-12-01", "Team/Meeting/2016-11-01", "Team", "Other/Child"} {
+		titles[w.titleHash(title)] = title
+	}
+	tree, node := w.pageTree(titles, "Team/Meeting/2016-12-01")
+	if len(tree) != 3 || tree[0].Name != "Home" || tree[1].Name != "Other" || tree[2].Name != "Team" {
+		t.Fatal("unexpected top level", pp.Sprint(tree))
+	}
+	if tree[1].Exists || tree[1].Open || !tree[2].Exists || !tree[2].Open {
+		t.Error("unexpected state", pp.Sprint(tree))
+	}
+	meeting := tree[2].Children[0]
+	if meeting.Name != "Meeting" || meeting.Exists || len(meeting.Children) != 2 ||
+		meeting.Children[0].Name != "2016-11-01" || meeting.Children[1] != node || !node.Current {
+		t.Error("unexpected children", pp.Sprint(meeting))
+	}
+
+	_, node = w.pageTree(titles, "Team/Meeting")
+	if len(node.Children) != 2 {
+		t.Error("subpages not found", pp.Sprint(node))
+	}
+}
+
+func TestTags(t *testing.T) {
+	body := "#Ops note #on-call See [intro](#intro) (#paren)\n`#code`\n```\n#fenced\n```\n# Heading #release\nissue#1 url/#anchor\n"
+	tags := parseTags(body)
+	if strings.Join(tags, ",") != "on-call,ops,release" {
+		t.Error("unexpected tags", tags)
+	}
+	html := string(h.db.renderHTML(&pageData{body: body}))
+	if !strings.Contains(html, `<span class="tag">#on-call</span>`) || strings.Contains(html, `#fenced</span>`) {
+		t.Error("unexpected tag rendering", html)
+	}
+
+	err := CheckStatus(http.StatusOK, "/tag", h.tagCloudHandler)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFrontMatter(t *testing.T) {
+	body := "---\nowner: alice\nstatus: draft\nreview-date: 2016-12-01\ntags: Ops, on-call\nteam:\n  name: infra\n---\n# Title #release\n"
+	meta, rest, err := parseFrontMatter(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Owner != "alice" || meta.Status != "draft" || len(meta.Tags) != 2 ||
+		fmt.Sprint(meta.Fields["team"]) != "map[name:infra]" || rest != "# Title #release\n" {
+		t.Error("unexpected front-matter", pp.Sprint(meta), rest)
+	}
+	if !meta.reviewOverdue(time.Date(2016, 12, 2, 0, 0, 0, 0, time.UTC)) || meta.reviewOverdue(time.Date(2016, 12, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Error("unexpected review date")
+	}
+	if !meta.matches(map[string]string{"owner": "Alice", "tag": "ops"}) || meta.matches(map[string]string{"status": "done"}) {
+		t.Error("unexpected filter")
+	}
+	if tags := parseTags(body); strings.Join(tags, ",") != "on-call,ops,release" {
+		t.Error("unexpected tags", tags)
+	}
+	if html := string(h.db.renderHTML(&pageData{body: body})); strings.Contains(html, "alice") {
+		t.Error("front-matter should be hidden", html)
+	}
+
+	_, _, err = parseFrontMatter("---\nreview-date: tomorrow\n---\n")
+	if err == nil {
+		t.Error("invalid review-date should be error")
+	}
+	if _, rest, _ := parseFrontMatter("---\nnot closed\n"); rest != "---\nnot closed\n" {
+		t.Error("unclosed front-matter should be body", rest)
+	}
+	for _, body := range []string{"---\nintro\n\n---\n\nbody", "---\n- a\n- b\n---\n"} {
+		if _, rest, err := parseFrontMatter(body); err != nil || rest != body {
+			t.Error("block which is not a mapping should be body", body, rest, err)
+		}
+	}
+}
+
+func TestChangelog(t *testing.T) {
+	now := time.Now()
+	if invertedTime(now) >= invertedTime(now.Add(-time.Second)) {
+		t.Error("newer change should be listed first")
+	}
+
+	f := changeFilter{User: "user", Namespace: "Team"}
+	for title, expected := range map[string]bool{"Team": true, "Team/Meeting": true, "Teams": false} {
+		if f.match(&changeData{User: "user", Title: title}) != expected {
+			t.Error("unexpected namespace filter", title)
+		}
+	}
+	if f.match(&changeData{User: "other", Title: "Team"}) {
+		t.Error("unexpected user filter")
+	}
+
+	err := CheckStatus(http.StatusNotFound, "/feed/atom?token=invalid", h.feedHandler)
+	if err != nil {
+		t.Error(err)
+	}
+	token := &feedTokenData{ID: "feed", User: "alice", Created: time.Now()}
+	h.db.saveBare(token)
+	req := httptest.NewRequest("GET", "/feed/atom?token="+h.db.feedToken(token), nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("format")
+	c.SetParamValues("atom")
+	err = h.feedHandler(c)
+	if err != nil || !strings.Contains(rec.Body.String(), `<feed xmlns="http://www.w3.org/2005/Atom">`) {
+		t.Error("unexpected feed", err, rec.Body.String())
+	}
+
+	// Revoked token and token of other users are refused.
+	err = CheckStatus(http.StatusNotFound, "/feed/token/feed/revoke", func(c echo.Context) error {
+		c.SetParamNames("id")
+		c.SetParamValues("feed")
+		return h.revokeFeedTokenHandler(c)
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	h.db.deleteBare(token)
+	if _, err = h.db.loadFeedToken(h.db.feedToken(token)); err == nil {
+		t.Error("revoked token should be refused")
+	}
+	if _, err = h.db.loadFeedToken("feed.forged"); err == nil {
+		t.Error("forged token should be refused")
+	}
+}
+
+// fakeSMTP accepts one mail and returns the data.
+func fakeSMTP(t *testing.T) (string, chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make(chan string, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tc := textproto.NewConn(conn)
+		tc.PrintfLine("220 localhost")
+		for {
+			line, err := tc.ReadLine()
+			if err != nil {
+				return
+			}
+			switch strings.ToUpper(strings.Fields(line + " ")[0]) {
+			case "EHLO", "HELO", "MAIL", "RCPT", "RSET", "NOOP":
+				tc.PrintfLine("250 OK")
+			case "DATA":
+				tc.PrintfLine("354 Go ahead")
+				lines, _ := tc.ReadDotLines()
+				data <- strings.Join(lines, "\n")
+				tc.PrintfLine("250 OK")
+			case "QUIT":
+				tc.PrintfLine("221 Bye")
+				return
+			default:
+				tc.PrintfLine("502 Not implemented")
+			}
+		}
+	}()
+	return l.Addr().String(), data
+}
+
+func TestNotify(t *testing.T) {
+	change := &changeData{Title: "Team/Meeting", TitleHash: "hash", Action: changeEdit, User: "alice", Summary: "agenda"}
+	if !(&watcher{Namespaces: map[string]bool{"Team": true}}).watches(change) ||
+		!(&watcher{Pages: map[string]bool{"hash": true}}).watches(change) ||
+		(&watcher{Namespaces: map[string]bool{"Tea": true}}).watches(change) {
+		t.Error("unexpected watch")
+	}
+	items := []*notification{{Change: change}}
+
+	addr, data := fakeSMTP(t)
+	s := &smtpNotifier{addr: addr, from: "wiki@example.com"}
+	err := s.notify("bob", &watcher{Email: "bob@example.com"}, items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mail := <-data
+	if !strings.Contains(mail, "To: bob@example.com") || !strings.Contains(mail, "Team/Meeting edit by alice") {
+		t.Error("unexpected mail", mail)
+	}
+
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&body)
+	}))
+	defer server.Close()
+	wh := &webhookNotifier{client: http.DefaultClient}
+	err = wh.notify("bob", &watcher{Webhook: server.URL}, items)
+	if err != nil || body["user"] != "bob" || len(body["changes"].([]interface{})) != 1 {
+		t.Error("unexpected webhook", err, body)
+	}
+
+	// Webhooks of users can't reach the internal network.
+	wh = &webhookNotifier{client: publicClient(time.Second)}
+	if err = wh.notify("bob", &watcher{Webhook: server.URL}, items); err == nil {
+		t.Error("webhook to loopback should fail")
+	}
+	for _, ip := range []string{"127.0.0.1", "10.0.0.1", "169.254.169.254", "::1", "fd00::1"} {
+		if publicIP(net.ParseIP(ip)) {
+			t.Error("should not be public", ip)
+		}
+	}
+	if !publicIP(net.ParseIP("8.8.8.8")) {
+		t.Error("should be public")
+	}
+	err = CheckStatus(http.StatusBadRequest, "/notifications/settings?webhook=http://169.254.169.254/", h.notificationSettingsHandler)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+type fakeNotifier struct {
+	notifierName string
+	err          error
+	sent         int
+}
+
+func (f *fakeNotifier) name() string {
+	return f.notifierName
+}
+
+func (f *fakeNotifier) notify(user string, to *watcher, items []*notification) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.sent += len(items)
+	return nil
+}
+
+func TestDigest(t *testing.T) {
+	email := &fakeNotifier{notifierName: "email"}
+	webhook := &fakeNotifier{notifierName: "webhook", err: errors.New("failed")}
+	notifiers := h.db.notifiers
+	h.db.notifiers = []notifier{email, webhook}
+	defer func() { h.db.notifiers = notifiers }()
+
+	h.db.updateWatcher("digest", func(wt *watcher) { wt.Pages["hash"] = true })
+	h.db.saveBare(&notificationData{User: "digest", Items: []*notification{{Change: &changeData{ID: "1"}}}})
+	h.db.sendDigests()
+	webhook.err = nil
+	h.db.sendDigests()
+	h.db.sendDigests()
+	if email.sent != 1 || webhook.sent != 1 {
+		t.Error("each notifier should send once", email.sent, webhook.sent)
+	}
+	if n := h.db.loadNotifications("digest"); !n.Items[0].Delivered {
+		t.Error("notification should be delivered", n.Items[0])
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	webhookBackoff = time.Millisecond
+	hook := &webhook{ID: "hook", Secret: "secret", Events: []string{eventPageUpdated}}
+	if !hook.accepts(eventPageUpdated) || hook.accepts(eventPageDeleted) {
+		t.Error("unexpected event filter")
+	}
+
+	attempts := 0
+	var event webhookEvent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get(webhookSignHeader) != webhookSignature("secret", body) {
+			t.Error("unexpected signature", r.Header.Get(webhookSignHeader))
+		}
+		json.Unmarshal(body, &event)
+	}))
+	defer server.Close()
+	hook.URL = server.URL
+
+	h.db.deliver(hook, &webhookEvent{ID: "1", Event: eventPageUpdated, Title: "Title"})
+	if attempts != 1 || len(h.db.retries) != 1 {
+		t.Fatal("failed delivery should be queued", attempts, h.db.retries)
+	}
+	time.Sleep(webhookBackoff)
+	h.db.retryWebhooks()
+	if attempts != 2 || len(h.db.retries) != 0 || event.Event != eventPageUpdated || event.Title != "Title" {
+		t.Error("unexpected delivery", attempts, event)
+	}
+	if dl := h.db.loadDeliveryLog(hook.ID); len(dl.Pending) != 0 {
+		t.Error("delivered event should not be pending", dl.Pending)
+	}
+
+	// Pending retries are loaded again after restart.
+	attempts = 0
+	h.db.saveBare(&webhookData{Hooks: []*webhook{hook}})
+	h.db.deliver(hook, &webhookEvent{ID: "2", Event: eventPageUpdated, Title: "Title"})
+	h.db.retries = nil
+	h.db.loadRetries()
+	if len(h.db.retries) != 1 || h.db.retries[0].Event.ID != "2" || h.db.retries[0].Attempt != 1 {
+		t.Fatal("pending retry should be loaded", h.db.retries)
+	}
+	time.Sleep(webhookBackoff)
+	h.db.retryWebhooks()
+	if attempts != 2 || len(h.db.retries) != 0 {
+		t.Error("loaded retry should be delivered", attempts)
+	}
+	h.db.saveBare(&webhookData{})
+}
+
+func TestCache(t *testing.T) {
+	configs, err := parseCacheConfig("page=2:1h,file=1", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configs["page"].Size != 2 || configs["page"].TTL != time.Hour || configs["file"].NegativeTTL != time.Minute {
+		t.Error("unexpected config", configs)
+	}
+	if _, err = parseCacheConfig("page=x", 0); err == nil {
+		t.Error("invalid size should be error")
+	}
+	if _, err = parseCacheConfig("pages=500", 0); err == nil {
+		t.Error("unknown cache should be error")
+	}
+
+	w := &Wikidata{cacheConfig: configs, config: defaultConfig()}
+	if c := w.cacheConfigOf("session"); c.Size != defaultCacheSizes["session"] || c.NegativeTTL != w.config.Cache.NegativeTTL {
+		t.Error("default size of the type should be used", c)
+	}
+	w.cacheConfig, _ = parseCacheConfig("default=10", time.Minute)
+	if c := w.cacheConfigOf("session"); c.Size != 10 {
+		t.Error("default of CACHE_CONFIG should be used as-is", c)
+	}
+
+	c := newCache("page", configs["page"])
+	a, b, missing := ts3.BareKey{Key: "a"}, ts3.BareKey{Key: "b"}, ts3.BareKey{Key: "missing"}
+	c.set(a, ts3.NewBare())
+	c.set(b, ts3.NewBare())
+	c.set(missing, nil)
+	if _, ok, _ := c.get(a); ok {
+		t.Error("a should be evicted")
+	}
+	if _, ok, err := c.get(missing); !ok || err != errCachedNotFound {
+		t.Error("missing should be negative entry", ok, err)
+	}
+	if v, ok, _ := c.get(b); !ok || v == nil {
+		t.Error("b should be cached")
+	}
+	stats := c.snapshot()
+	if stats.Hits != 1 || stats.Misses != 1 || stats.Negative != 1 || stats.Evictions != 1 || stats.Len != 2 {
+		t.Error("unexpected stats", stats)
+	}
+	c.flush()
+	if _, ok, _ := c.get(b); ok {
+		t.Error("b should be flushed")
+	}
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	bus := &memoryInvalidator{}
+	var instances []*Wikidata
+	for i := 0; i < 2; i++ {
+		w := &Wikidata{svc: &mockS3{}, bucket: "testbucket", wikiSecret: "testSecret"}
+		w.initializeCache()
+		err := w.setInvalidator(bus)
+		if err != nil {
+			t.Fatal(err)
+		}
+		instances = append(instances, w)
+	}
+	a, b := instances[0], instances[1]
+
+	md := &pageData{titleHash: "hash"}
+	err := b.loadBare(md)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.saveBare(&pageData{titleHash: "hash", title: "title", body: "new"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := b.caches[reflect.TypeOf(pageData{})]
+	if stats := page.snapshot(); stats.Len != 0 || stats.Invalidated != 1 {
+		t.Error("page should be invalidated", stats)
+	}
+	if stats := a.caches[reflect.TypeOf(pageData{})].snapshot(); stats.Len != 1 || stats.Invalidated != 0 {
+		t.Error("writer should keep its cache", stats)
+	}
+
+	id, _, inv, err := parseMarker(invalidationPrefix + invertedTime(time.Now()) + "-origin-12345678/page/page/hash/index.md")
+	if err != nil || inv.Origin != "origin" || inv.Cache != "page" || inv.Key != "page/hash/index.md" || !strings.HasSuffix(id, "-12345678") {
+		t.Error("unexpected marker", id, inv, err)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	storageBackoff = time.Millisecond
+	attempts := 0
+	s := h.db.background()
+	err := s.retry(func() error {
+		attempts++
+		if attempts < 3 {
+			return awserr.New("RequestError", "connection reset", nil)
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Error("transient error should be retried", attempts, err)
+	}
+
+	attempts = 0
+	err = s.retry(func() error {
+		attempts++
+		return awserr.New("AccessDenied", "denied", nil)
+	})
+	if err == nil || attempts != 1 {
+		t.Error("permanent error should not be retried", attempts, err)
+	}
+}
+
+func TestPutPageFailure(t *testing.T) {
+	storageBackoff = time.Millisecond
+	w := &Wikidata{svc: &failingS3{}, bucket: "testbucket", config: defaultConfig()}
+	w.initializeCache()
+	w.markdown = h.db.markdown
+	fh := &handler{db: w}
+
+	form := url.Values{
+		"title":   []string{"Failure"},
+		"body":    []string{"unsaved body"},
+		"summary": []string{"unsaved summary"},
+	}
+	req := httptest.NewRequest(echo.POST, "/page/", strings.NewReader(form.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("titleHash")
+	c.SetParamValues(w.titleHash("Failure"))
+	c.Set("session", &sessionData{Login: true, User: "user"})
+
+	err := fh.putPageHandler(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Error("transient failure should be 503", rec.Code)
+	}
+	for _, s := range []string{"unsaved body", `value="unsaved summary"`, "Failed to save the page"} {
+		if !strings.Contains(rec.Body.String(), s) {
+			t.Error("edit form should keep the input", s, rec.Body.String())
+		}
+	}
+}
+
+func TestACLUnchanged(t *testing.T) {
+	fake := &countingS3{}
+	w := &Wikidata{svc: fake, bucket: "testbucket", config: defaultConfig()}
+	w.initializeCache()
+	ah := &handler{db: w}
+
+	// Pages of mockS3 are public.
+	req := httptest.NewRequest(echo.POST, "/page/", strings.NewReader("acl=public"))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("titleHash")
+	c.SetParamValues("hash")
+	c.Set("session", &sessionData{Login: true, User: "user"})
+	err := ah.aclHandler(c)
+	if err != nil || rec.Code != http.StatusFound {
+		t.Fatal("unexpected response", rec.Code, err)
+	}
+	if fake.puts != 0 {
+		t.Error("unchanged ACL should not record the change", fake.puts)
+	}
+}
+
+// countingS3 counts objects put.
+type countingS3 struct {
+	mockS3
+	puts int
+}
+
+func (m *countingS3) PutObject(i *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	m.puts++
+	return m.mockS3.PutObject(i)
+}
+
+// failingS3 fails to put objects, as S3 is unavailable.
+type failingS3 struct {
+	mockS3
+}
+
+func (m *failingS3) PutObject(*s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	return nil, awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "unavailable", nil), http.StatusServiceUnavailable, "id")
+}
+
+func TestMetrics(t *testing.T) {
+	var hv histogramVec
+	hv.observe(label("operation", "Get"), 20*time.Millisecond)
+	hv.observe(label("operation", "Get"), 2*time.Second)
+	var buf bytes.Buffer
+	hv.write(&buf, "latency", "test")
+	for _, line := range []string{
+		`latency_bucket{operation="Get",le="0.01"} 0`,
+		`latency_bucket{operation="Get",le="0.025"} 1`,
+		`latency_bucket{operation="Get",le="+Inf"} 2`,
+		`latency_count{operation="Get"} 2`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Error("missing", line, buf.String())
+		}
+	}
+
+	metrics.uploadBytes.add("", 10)
+	err := CheckStatus(http.StatusForbidden, "/metrics", h.metricsHandler)
+	if err != nil {
+		t.Error("metrics should be admin only without token", err)
+	}
+	h.db.config.MetricsToken = "token"
+	defer func() { h.db.config.MetricsToken = "" }()
+	req := httptest.NewRequest(echo.GET, "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	err = h.metricsHandler(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, "bucketwiki_upload_bytes_total 10\n") || !strings.Contains(body, `bucketwiki_cache_hits_total{cache="page"}`) {
+		t.Error("unexpected metrics", body)
+	}
+}
+
+func TestMetricsSessions(t *testing.T) {
+	m := &metricsRegistry{sessions: make(map[string]time.Time), pruneAt: minSessionsPrune}
+	for i := 0; i < minSessionsPrune-1; i++ {
+		m.sessions[fmt.Sprint(i)] = time.Now().Add(-2 * activeSessionWindow)
+	}
+	m.touchSession("active")
+	if len(m.sessions) != 1 || m.pruneAt != minSessionsPrune {
+		t.Error("inactive sessions should be pruned on insert", len(m.sessions), m.pruneAt)
+	}
+}
+
+func TestLogging(t *testing.T) {
+	entry := log.WithFields(log.Fields{"sessionID": "secret-id", "user": "alice", "swept": 1, "responseTime": 2})
+	redactHook{}.Fire(entry)
+	if entry.Data["sessionID"] != "[REDACTED]" || entry.Data["user"] != "alice" || entry.Data["swept"] != 1 || entry.Data["responseTime"] != 2 {
+		t.Error("unexpected redaction", entry.Data)
+	}
+
+	handler := requestIDMiddleware()(func(c echo.Context) error {
+		return c.String(http.StatusOK, c.Get("requestID").(string))
+	})
+	for id, valid := range map[string]bool{"abc-123": true, "bad id\n": false} {
+		req := httptest.NewRequest(echo.GET, "/", nil)
+		req.Header.Set(requestIDHeader, id)
+		rec := httptest.NewRecorder()
+		err := handler(e.NewContext(req, rec))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := rec.Header().Get(requestIDHeader)
+		if got != rec.Body.String() || (got == id) != valid || got == "" {
+			t.Error("unexpected request ID", id, got)
+		}
+	}
+}
+
+func TestAudit(t *testing.T) {
+	f := auditFilter{Actor: "alice", Action: auditLogin}
+	if !f.match(&auditData{Actor: "alice", Action: auditLogin}) || f.match(&auditData{Actor: "bob", Action: auditLogin}) {
+		t.Error("unexpected audit filter")
+	}
+
+	for _, format := range []string{"", "jsonl"} {
+		req := httptest.NewRequest(echo.GET, "/admin/audit?actor=alice&format="+format, nil)
+		req.Header.Set("User-Agent", "test")
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.Set("session", &sessionData{User: "admin"})
+		err := h.auditHandler(c)
+		if err != nil || rec.Code != http.StatusOK {
+			t.Error("unexpected audit page", format, err, rec.Code)
+		}
+
+		a := &auditData{Action: auditLogout}
+		h.audit(c, a)
+		if a.Actor != "admin" || a.UserAgent != "test" || a.ID == "" {
+			t.Error("unexpected audit entry", a)
+		}
+	}
+
+	// Entries are paged, and not cached.
+	fake := &auditS3{entries: make(map[string][]byte)}
+	for i := 0; i < 3; i++ {
+		a := &auditData{ID: fmt.Sprintf("%d", i), Action: auditLogin}
+		fake.entries["audit/"+a.ID], _ = json.Marshal(a)
+	}
+	w := &Wikidata{svc: fake, bucket: "testbucket", config: defaultConfig()}
+	w.initializeCache()
+	entries, next, err := w.listAudit(auditFilter{}, "", 2)
+	if err != nil || len(entries) != 2 || next != "1" {
+		t.Fatal("unexpected first page", entries, next, err)
+	}
+	entries, next, err = w.listAudit(auditFilter{}, next, 2)
+	if err != nil || len(entries) != 1 || entries[0].ID != "2" || next != "" {
+		t.Error("unexpected last page", entries, next, err)
+	}
+	if stats := w.caches[reflect.TypeOf(auditData{})].snapshot(); stats.Len != 0 {
+		t.Error("audit entries should not be cached", stats)
+	}
+}
+
+// auditS3 lists entries sorted by key.
+type auditS3 struct {
+	mockS3
+	entries map[string][]byte
+}
+
+func (m *auditS3) ListObjectsV2(i *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	var keys []string
+	for key := range m.entries {
+		if strings.HasPrefix(key, *i.Prefix) && key > aws.StringValue(i.StartAfter) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	out := &s3.ListObjectsV2Output{}
+	for _, key := range keys {
+		out.Contents = append(out.Contents, &s3.Object{Key: aws.String(key)})
+	}
+	return out, nil
+}
+
+func (m *auditS3) GetObject(i *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	return &s3.GetObjectOutput{
+		Body:        ioutil.NopCloser(bytes.NewReader(m.entries[*i.Key])),
+		ContentType: aws.String("application/json"),
+	}, nil
+}
+
+func TestHealth(t *testing.T) {
+	err := CheckStatus(http.StatusOK, "/healthz", h.healthzHandler)
+	if err != nil {
+		t.Error(err)
+	}
+	err = CheckStatus(http.StatusOK, "/readyz", h.readyzHandler)
+	if err != nil {
+		t.Error(err)
+	}
+
+	w := &Wikidata{svc: &mockS3{}, bucket: "testbucket"}
+	r := w.checkReady()
+	if r.Ready || r.Checks["storage"] != "ok" || r.Checks["templates"] != "fail" {
+		t.Error("not ready without templates", r)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucketwiki")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yml")
+	err = ioutil.WriteFile(path, []byte(`
+url: https://wiki.example.com/
+secret: secret
+storage:
+  bucket: file-bucket
+  region: ap-northeast-1
+auth:
+  adminUsers: [alice]
+cache:
+  negativeTTL: 1m
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env := map[string]string{
+		"BUCKETWIKI_CONFIG": path,
+		"AWS_BUCKET_NAME":   "env-bucket",
+		"ADMIN_USERS":       "bob, carol",
+		"PORT":              "3000",
+	}
+	lookupEnv := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+	c, err := loadConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-listen", "127.0.0.1:9000"}, lookupEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Storage.Bucket != "env-bucket" || c.Storage.Region != "ap-northeast-1" {
+		t.Error("env should override file", c.Storage)
+	}
+	if c.Listen != "127.0.0.1:9000" || c.URL != "https://wiki.example.com" {
+		t.Error("unexpected listen or URL", c.Listen, c.URL)
+	}
+	if c.Cache.NegativeTTL != time.Minute || c.Notify.Interval != time.Hour {
+		t.Error("unexpected durations", c.Cache.NegativeTTL, c.Notify.Interval)
+	}
+	if !c.isAdmin("carol") || c.isAdmin("alice") {
+		t.Error("unexpected admins", c.Auth.AdminUsers)
+	}
+
+	env = map[string]string{
+		"AWS_BUCKET_NAME":    "bucket",
+		"DEBUG":              "yes",
+		"CACHE_INVALIDATION": "redis",
+		"MAX_PAGE_SIZE":      "-1",
+	}
+	_, err = loadConfig(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-url", "wiki.example.com"}, lookupEnv)
+	if err == nil {
+		t.Fatal("invalid config should fail")
+	}
+	for _, field := range []string{"DEBUG", "AWS_BUCKET_REGION", "WIKI_SECRET", "url (URL)", "redis", "limits"} {
+		if !strings.Contains(err.Error(), field) {
+			t.Errorf("error should mention %s: %v", field, err)
+		}
+	}
+}
+
+// setupS3 keeps bucket settings, for setup.
+type setupS3 struct {
+	mockS3
+	versioning string
+	website    *s3.WebsiteConfiguration
+	cors       []*s3.CORSRule
+	lifecycle  []*s3.LifecycleRule
+}
+
+func (m *setupS3) GetBucketVersioning(*s3.GetBucketVersioningInput) (*s3.GetBucketVersioningOutput, error) {
+	return &s3.GetBucketVersioningOutput{Status: aws.String(m.versioning)}, nil
+}
+
+func (m *setupS3) PutBucketVersioning(i *s3.PutBucketVersioningInput) (*s3.PutBucketVersioningOutput, error) {
+	m.versioning = *i.VersioningConfiguration.Status
+	return &s3.PutBucketVersioningOutput{}, nil
+}
+
+func (m *setupS3) GetBucketWebsite(*s3.GetBucketWebsiteInput) (*s3.GetBucketWebsiteOutput, error) {
+	if m.website == nil {
+		return nil, awserr.New("NoSuchWebsiteConfiguration", "not found", nil)
+	}
+	return &s3.GetBucketWebsiteOutput{IndexDocument: m.website.IndexDocument}, nil
+}
+
+func (m *setupS3) PutBucketWebsite(i *s3.PutBucketWebsiteInput) (*s3.PutBucketWebsiteOutput, error) {
+	m.website = i.WebsiteConfiguration
+	return &s3.PutBucketWebsiteOutput{}, nil
+}
+
+func (m *setupS3) GetBucketCors(*s3.GetBucketCorsInput) (*s3.GetBucketCorsOutput, error) {
+	if m.cors == nil {
+		return nil, awserr.New("NoSuchCORSConfiguration", "not found", nil)
+	}
+	return &s3.GetBucketCorsOutput{CORSRules: m.cors}, nil
+}
+
+func (m *setupS3) PutBucketCors(i *s3.PutBucketCorsInput) (*s3.PutBucketCorsOutput, error) {
+	m.cors = i.CORSConfiguration.CORSRules
+	return &s3.PutBucketCorsOutput{}, nil
+}
+
+func (m *setupS3) GetBucketLifecycleConfiguration(*s3.GetBucketLifecycleConfigurationInput) (*s3.GetBucketLifecycleConfigurationOutput, error) {
+	if m.lifecycle == nil {
+		return nil, awserr.New("NoSuchLifecycleConfiguration", "not found", nil)
+	}
+	return &s3.GetBucketLifecycleConfigurationOutput{Rules: m.lifecycle}, nil
+}
+
+func (m *setupS3) PutBucketLifecycleConfiguration(i *s3.PutBucketLifecycleConfigurationInput) (*s3.PutBucketLifecycleConfigurationOutput, error) {
+	m.lifecycle = i.LifecycleConfiguration.Rules
+	return &s3.PutBucketLifecycleConfigurationOutput{}, nil
+}
+
+func TestSetup(t *testing.T) {
+	other := &s3.LifecycleRule{
+		ID:     aws.String("other"),
+		Filter: &s3.LifecycleRuleFilter{Prefix: aws.String("tmp/")},
+		Status: aws.String(s3.ExpirationStatusEnabled),
+	}
+	bucket := &setupS3{versioning: s3.BucketVersioningStatusSuspended, lifecycle: []*s3.LifecycleRule{other}}
+	c := defaultConfig()
+	c.URL = "https://wiki.example.com"
+	c.Cache.Invalidation = "s3"
+	w := &Wikidata{svc: bucket, bucket: "testbucket", config: c}
+
+	for _, sc := range w.runSetup(defaultSetupOptions, false) {
+		if sc.ok() || sc.Problem == "" {
+			t.Error("should be a problem", sc)
+		}
+	}
+	for _, sc := range w.runSetup(defaultSetupOptions, true) {
+		if !sc.Fixed {
+			t.Error("should be fixed", sc)
+		}
+	}
+	for _, sc := range w.runSetup(defaultSetupOptions, false) {
+		if !sc.ok() || sc.Problem != "" {
+			t.Error("should be ok", sc)
+		}
+	}
+	if len(bucket.lifecycle) != 3 || bucket.lifecycle[0] != other {
+		t.Error("other rules should be kept", bucket.lifecycle)
+	}
+	for _, r := range bucket.lifecycle[1:] {
+		if r.NoncurrentVersionExpiration == nil || r.Expiration == nil {
+			t.Error("expired objects should not be kept as versions", r)
+		}
+	}
+
+	w.runSetup(setupOptions{versionDays: 30}, true)
+	for _, r := range bucket.lifecycle {
+		if p := aws.StringValue(r.Filter.Prefix); p == "" || strings.HasPrefix(p, "page/") {
+			t.Error("history of pages should be kept", r)
+		}
+	}
+	w.runSetup(setupOptions{versionDays: 30, versionPages: true}, true)
+	all := false
+	for _, r := range bucket.lifecycle {
+		all = all || aws.StringValue(r.Filter.Prefix) == "" && r.NoncurrentVersionExpiration != nil
+	}
+	if !all {
+		t.Error("old versions of pages should expire with versionPages", bucket.lifecycle)
+	}
+
+	c.Publish.Target = "server"
+	c.Cache.Invalidation = ""
+	checks := w.runSetup(setupOptions{}, false)
+	if checks[1].Skipped == "" || checks[3].Skipped == "" {
+		t.Error("website and lifecycle should be skipped", checks)
+	}
+}
+
+func TestJobs(t *testing.T) {
+	r := newJobRunner()
+	runs := make(chan bool, 10)
+	r.add("test", time.Millisecond, func() error {
+		runs <- true
+		return errors.New("failed")
+	})
+	r.start()
+	<-runs
+	<-runs
+	r.shutdown()
+
+	status := r.snapshot()
+	if len(status) != 1 || status[0].Runs < 2 || status[0].Failures != status[0].Runs || status[0].Error != "failed" {
+		t.Error("unexpected status", status)
+	}
+
+	err := h.db.rebuildIndexes()
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Pages updated during the rebuild are kept.
+	h.db.rebuilt = make(map[string]bool)
+	err = h.db.setTags("updated", "#fresh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := &tagIndexData{Pages: make(reverseIndex)}
+	err = h.db.mergeIndexes(&titleIndexData{Titles: make(map[string]string)}, tags,
+		&includeIndexData{Includers: make(reverseIndex)}, &metaIndexData{Pages: make(map[string]*frontMatter)})
+	h.db.rebuilt = nil
+	if err != nil || !tags.Pages["fresh"]["updated"] {
+		t.Error("updated page should be merged", err, tags.Pages)
+	}
+	err = h.db.sweepSessions(time.Hour)
+	if err != nil {
+		t.Error(err)
+	}
+}